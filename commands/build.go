@@ -20,7 +20,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/kevinkenan/cobra"
 	"github.com/kevinkenan/subtext/core"
@@ -29,6 +32,12 @@ import (
 const (
 	buildDesc = `Copies the contents from the specified to directory to the output directory,
 processing subtext files as it goes.
+
+With --jobs, the files that define macros or data with newmacro or setdata are
+rendered first, one at a time in order, and the rest are then rendered at the
+same time. Every other file sees all of those definitions, so the output
+doesn't depend on the number of jobs. Definitions in imported files are made
+when the importing file is rendered, so import the definitions a file uses.
 `
 )
 
@@ -40,10 +49,16 @@ func Build() (cmd *cobra.Command) {
 	cmd.AddFlags(
 		cobra.NewStringFlag("output", cobra.Opts().Abbr("o").Req(true).Desc("path to the output directory")),
 		cobra.NewBoolFlag("recurse", cobra.Opts().Default(false).Desc("includes contents of subdirectories")),
+		cobra.NewBoolFlag("incremental", cobra.Opts().Default(false).Desc("skip files whose inputs have not changed since the last build")),
+		cobra.NewBoolFlag("watch", cobra.Opts().Default(false).Desc("rebuild when the sources change")),
+		cobra.NewStringFlag("jobs", cobra.Opts().Abbr("j").Default("1").Desc("number of files to render at the same time")),
+		cobra.NewBoolFlag("keep-going", cobra.Opts().Default(false).Desc("report every error instead of stopping at the first")),
 		cobra.NewBoolFlag("reflow", cobra.Opts().Default(false).Desc("reflow paragraphs")),
 		cobra.NewStringFlag("format", cobra.Opts().Desc("the output format")),
 		cobra.NewStringSliceFlag("package-dir", cobra.Opts().Desc("path to a package directory. you may set this multiple times")),
 		cobra.NewStringSliceFlag("packages", cobra.Opts().Abbr("p").Desc("macro package(s) to apply to input")))
+	addSigilFlags(cmd)
+	addImportFlags(cmd)
 
 	return
 }
@@ -57,34 +72,114 @@ func BuildRunE(cmd *cobra.Command, args []string) (err error) {
 	}
 
 	cobra.WithField("files", args).Log("processing")
-	outdir := cobra.GetString("output")
-	f := core.NewFolio()
-	f.Cmd = cmd
 
-	for _, pdir := range cobra.GetStringSlice("package-dir") {
-		path := filepath.Clean(pdir)
-		f.PkgSearchPaths = append(f.PkgSearchPaths, path)
+	if !cobra.GetBool("watch") {
+		_, err = buildSite(cmd, args, cobra.GetString("output"), cobra.GetBool("incremental"))
+		return reportErrors(err)
+	}
+
+	roots := append([]string{}, args...)
+	roots = append(roots, cobra.GetStringSlice("package-dir")...)
+
+	return watch(roots, []string{cobra.GetString("output")}, nil, func() ([]string, error) {
+		return buildSite(cmd, args, cobra.GetString("output"), true)
+	})
+}
+
+// buildSite builds every source directory in args into outdir. When
+// incremental is true, unchanged files are skipped and buildSite returns the
+// paths of all the inputs recorded in the manifest.
+func buildSite(cmd *cobra.Command, args []string, outdir string, incremental bool) (inputs []string, err error) {
+	jobs, err := strconv.Atoi(cobra.GetString("jobs"))
+	if err != nil || jobs < 1 {
+		return nil, fmt.Errorf("jobs must be a positive integer: %q", cobra.GetString("jobs"))
 	}
 
+	f := newFolio(cmd)
+
 	f.Packages = cobra.GetStringSlice("packages")
 	if len(f.Packages) > 0 {
 		err = f.LoadPackages(f.Packages)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+
+	b := &siteBuild{folio: f, outroot: outdir}
+	if incremental {
+		// The sigils change how every file is scanned, so the manifest is
+		// ignored if they, or any other setting that affects every output,
+		// changed since the last build.
+		opts := fmt.Sprintf("format=%s reflow=%t packages=%v package-dir=%v include-dir=%v import-root=%s sigils=%+v sigil-overrides=%+v",
+			cobra.GetString("format"), cobra.GetBool("reflow"),
+			f.Packages, cobra.GetStringSlice("package-dir"), cobra.GetStringSlice("include-dir"),
+			f.ImportRoot, f.Sigils, f.Overrides.Sigils)
+		b.manifest, err = loadManifest(outdir, opts)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	for _, a := range args {
-		err = copyDir(a, outdir, f)
+		err = b.copyDir(a, outdir)
 		if err != nil {
-			return err
+			break
 		}
 	}
 
-	return nil
+	if err == nil {
+		if errs := b.makeSite(jobs); len(errs) > 0 {
+			err = errs
+		}
+	}
+
+	if b.manifest == nil {
+		return nil, err
+	}
+
+	// Save the manifest even if a file failed so the files that did build
+	// are skipped next time.
+	if serr := b.manifest.save(); serr != nil && err == nil {
+		err = serr
+	}
+
+	return b.manifest.inputs(), err
+}
+
+// siteBuild holds the state of a single build.
+type siteBuild struct {
+	folio    *core.Folio
+	outroot  string     // the output directory of the site
+	manifest *manifest  // nil unless the build is incremental
+	mu       sync.Mutex // guards manifest while pages are rendered
+	pages    []*page    // pages to render
+	indexes  []*page    // index pages, rendered after all other pages
+}
+
+// page is a subtext file waiting to be rendered.
+type page struct {
+	src      string
+	outdir   string
+	doc      *core.Document
+	upToDate bool // true if the page is only rendered for the refs it defines
+	failed   bool // true if the page couldn't be rendered
 }
 
-func copyDir(src, outdir string, folio *core.Folio) (err error) {
+// buildErrors collects the errors of the pages that failed to render.
+type buildErrors []error
+
+func (e buildErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// copyDir copies src to outdir and queues the subtext files found along the
+// way. If the build is incremental, files whose inputs are unchanged
+// according to the manifest are skipped.
+func (b *siteBuild) copyDir(src, outdir string) (err error) {
 	src = filepath.Clean(src)
 	outdir = filepath.Clean(outdir)
 
@@ -113,14 +208,12 @@ func copyDir(src, outdir string, folio *core.Folio) (err error) {
 		return fmt.Errorf("unable to read source directory: %s", err)
 	}
 
-	indexes := []string{}
-
 	for _, entry := range entries {
 		srcpath := filepath.Join(src, entry.Name())
 
 		if entry.IsDir() {
 			subdir := filepath.Join(outdir, entry.Name())
-			err = copyDir(srcpath, subdir, folio)
+			err = b.copyDir(srcpath, subdir)
 			if err != nil {
 				return
 			}
@@ -134,17 +227,18 @@ func copyDir(src, outdir string, folio *core.Folio) (err error) {
 			case ".stm":
 				// skip
 			case ".st":
-				if strings.HasPrefix(filepath.Base(srcpath), "index.") {
-					indexes = append(indexes, srcpath)
-					continue
+				p, err := b.addPage(srcpath, outdir)
+				if err != nil {
+					return err
 				}
 
-				err = makeFile(srcpath, outdir, folio)
-				if err != nil {
-					return
+				if strings.HasPrefix(filepath.Base(srcpath), "index.") {
+					b.indexes = append(b.indexes, p)
+				} else {
+					b.pages = append(b.pages, p)
 				}
 			default:
-				err = copyFile(srcpath, outdir)
+				err = copyFile(srcpath, outdir, b.manifest)
 				if err != nil {
 					return
 				}
@@ -152,32 +246,145 @@ func copyDir(src, outdir string, folio *core.Folio) (err error) {
 		}
 	}
 
-	for _, i := range indexes {
-		err = makeFile(i, outdir, folio)
-		if err != nil {
-			return
-		}
-	}
-
 	return
 }
 
-func makeFile(src, outdir string, folio *core.Folio) (err error) {
+// addPage reads src and adds it to the Folio.
+func (b *siteBuild) addPage(src, outdir string) (*page, error) {
 	input, err := ioutil.ReadFile(src)
 	if err != nil {
-		return fmt.Errorf("makefile: %s", err)
+		return nil, fmt.Errorf("makefile: %s", err)
 	}
 
-	srcname := filepath.Base(src)
-	d := core.NewDoc(srcname, src)
-	err = folio.AppendDoc(d)
+	d := core.NewDoc(filepath.Base(src), src)
+	err = b.folio.AppendDoc(d)
 	if err != nil {
-		return
+		return nil, err
 	}
 	d.Text = string(input)
 	// d.Plain = true
 
-	output, err := d.Make()
+	// Refs link to the page by its path in the site.
+	if rel, err := filepath.Rel(b.outroot, filepath.Join(outdir, outputName(d))); err == nil {
+		d.OutputPath = rel
+	}
+
+	p := &page{src: src, outdir: outdir, doc: d}
+	if b.manifest != nil && b.manifest.upToDate(src, b.folio.PkgFiles) {
+		cobra.WithField("file", src).Log("unchanged, skipping")
+		p.upToDate = true
+	}
+
+	return p, nil
+}
+
+// makeSite renders the pages and then writes them. Refs are resolved once
+// every page has been rendered, so a page can refer to labels defined in any
+// other page, and tables of contents can list the headings of every page.
+// Pages that are up to date are only rendered if they define labels or if a
+// page lists the headings of the whole site.
+func (b *siteBuild) makeSite(jobs int) (errs buildErrors) {
+	if err := b.folio.FirstPass(); err != nil {
+		errs = append(errs, err)
+		if !b.folio.KeepGoing {
+			return
+		}
+	}
+
+	folioTOC := b.folio.HasFolioTOC()
+	render := func(p *page) error {
+		if p.upToDate && !p.doc.DefinesRefs() && !p.doc.DefinesMacros() && !folioTOC {
+			return nil
+		}
+		_, err := p.doc.MakeDeferred()
+		p.failed = err != nil
+		if p.doc.HasFolioTOC() {
+			// The headings of any page may have changed, including pages
+			// added since the last build.
+			p.upToDate = false
+		}
+		return err
+	}
+
+	// Index pages are rendered last so that they can refer to everything
+	// else in the site.
+	errs = append(errs, b.renderPages(b.pages, jobs, render)...)
+	errs = append(errs, b.renderPages(b.indexes, jobs, render)...)
+
+	all := append(append([]*page{}, b.pages...), b.indexes...)
+	errs = append(errs, b.makePages(all, jobs, b.makeFile)...)
+	return
+}
+
+// renderPages renders the pages that define macros or data one at a time, in
+// order, and then the rest of the pages using up to jobs goroutines. Every
+// page that doesn't define anything sees all of the definitions, so the
+// output is the same whatever the number of jobs. Definitions made in
+// imported files aren't known until the page is rendered, so a page should
+// import the definitions it uses.
+func (b *siteBuild) renderPages(pages []*page, jobs int, render func(*page) error) (errs buildErrors) {
+	var defining, rest []*page
+	for _, p := range pages {
+		if p.doc.DefinesMacros() {
+			defining = append(defining, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+
+	errs = append(errs, b.makePages(defining, 1, render)...)
+	errs = append(errs, b.makePages(rest, jobs, render)...)
+	return
+}
+
+// makePages calls fn with each page using up to jobs goroutines and returns
+// the errors of the pages that failed.
+func (b *siteBuild) makePages(pages []*page, jobs int, fn func(*page) error) (errs buildErrors) {
+	queue := make(chan *page)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				if err := fn(p); err != nil {
+					switch err.(type) {
+					case *core.Diagnostic, core.Diagnostics:
+						// Diagnostics already name the file.
+					default:
+						err = fmt.Errorf("%s: %s", p.src, err)
+					}
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, p := range pages {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+
+	// Report errors in a stable order regardless of which page finished
+	// first.
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return
+}
+
+// makeFile resolves the refs and tables of contents of a rendered page and
+// writes it to its output directory.
+func (b *siteBuild) makeFile(p *page) (err error) {
+	src, d := p.src, p.doc
+	if p.upToDate || p.failed {
+		return nil
+	}
+
+	output, err := d.ResolveRefs()
 	if err != nil {
 		return
 	}
@@ -189,12 +396,7 @@ func makeFile(src, outdir string, folio *core.Folio) (err error) {
 	// 	return
 	// }
 
-	outname := d.OutputName
-	if d.OutputName == "" {
-		outname = fmt.Sprintf("%s.%s", strings.TrimSuffix(srcname, ".st"), d.Format)
-	}
-
-	dstpath, err := filepath.Abs(filepath.Join(outdir, outname))
+	dstpath, err := filepath.Abs(filepath.Join(p.outdir, outputName(d)))
 	if err != nil {
 		return fmt.Errorf("makefile: %s", err)
 	}
@@ -229,13 +431,35 @@ func makeFile(src, outdir string, folio *core.Folio) (err error) {
 		return fmt.Errorf("makefile: %s", err)
 	}
 
+	if b.manifest != nil {
+		inputs := append([]string{src}, b.folio.PkgFiles...)
+		inputs = append(inputs, d.Imports...)
+		inputs = append(inputs, d.Refs...)
+		b.mu.Lock()
+		err = b.manifest.record(src, dstpath, inputs)
+		b.mu.Unlock()
+	}
+
 	return
 }
 
-func copyFile(src, outdir string) (err error) {
+// outputName returns the name of the file the document is written to.
+func outputName(d *core.Document) string {
+	if d.OutputName != "" {
+		return d.OutputName
+	}
+	return fmt.Sprintf("%s.%s", strings.TrimSuffix(d.Name, ".st"), d.Format)
+}
+
+func copyFile(src, outdir string, m *manifest) (err error) {
 	fname := filepath.Base(src)
 	dst := filepath.Join(outdir, fname)
 
+	if m != nil && m.upToDate(src, nil) {
+		cobra.WithField("file", src).Log("unchanged, skipping")
+		return
+	}
+
 	in, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("copyfile: %s", err)
@@ -272,5 +496,9 @@ func copyFile(src, outdir string) (err error) {
 		return fmt.Errorf("copyfile: %s", err)
 	}
 
+	if m != nil {
+		err = m.record(src, dst, []string{src})
+	}
+
 	return
 }
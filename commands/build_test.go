@@ -0,0 +1,82 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+// buildJobs builds src into a new directory in dir using the number of jobs
+// and returns the contents of the output files.
+func buildJobs(t *testing.T, dir, src string, jobs int) map[string]string {
+	out, err := ioutil.TempDir(dir, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &siteBuild{folio: core.NewFolio(), outroot: out}
+	if err = b.copyDir(src, out); err != nil {
+		t.Fatal(err)
+	}
+	if errs := b.makeSite(jobs); len(errs) > 0 {
+		t.Fatalf("-j %d: %s", jobs, errs)
+	}
+
+	files, err := ioutil.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := map[string]string{}
+	for _, fi := range files {
+		text, err := ioutil.ReadFile(filepath.Join(out, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[fi.Name()] = string(text)
+	}
+	return outputs
+}
+
+func TestBuildJobs(t *testing.T) {
+	// The macro is defined by c.st and used by the pages before and after it.
+	files := map[string]string{
+		"src/c.st": "•(newmacro){\n    name: greet\n    parameters: [text]\n    template: \"hello [[.text]]\"\n}\n•greet{c}",
+	}
+	for _, name := range []string{"a", "b", "d", "e", "f", "g"} {
+		files["src/"+name+".st"] = "•greet{" + name + "}"
+	}
+	dir := writeFiles(t, files)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+
+	exp := buildJobs(t, dir, src, 1)
+	if exp["a."] != "<hello a>\n" {
+		t.Errorf("a.st\nExpected: %q\n     Got: %q", "<hello a>\n", exp["a."])
+	}
+
+	for i := 0; i < 5; i++ {
+		got := buildJobs(t, dir, src, 4)
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Errorf("-j 4 differs from -j 1\nExpected: %q\n     Got: %q", exp, got)
+			break
+		}
+	}
+}
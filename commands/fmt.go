@@ -0,0 +1,173 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kevinkenan/cobra"
+	"github.com/kevinkenan/subtext/core"
+)
+
+const (
+	fmtDesc = `Rewrites .st and .stm files in the canonical style. Only the layout of
+command contexts and trailing whitespace that doesn't reach the output are
+changed, so the formatted files produce the same output as before.
+
+Directories are searched for .st and .stm files. With no files, the text is
+read from stdin and the formatted text is written to stdout.
+`
+)
+
+func Fmt() (cmd *cobra.Command) {
+	cmd = cobra.NewCommand("fmt")
+	cmd.Short = "rewrite files in the canonical style"
+	cmd.Long = fmtDesc
+	cmd.RunE = FmtRunE
+	cmd.AddFlags(
+		cobra.NewBoolFlag("check", cobra.Opts().Abbr("l").Default(false).Desc("list the files that aren't formatted instead of rewriting them")),
+		cobra.NewBoolFlag("plain", cobra.Opts().Default(false).Desc("process the text in plain mode")),
+		cobra.NewBoolFlag("reflow", cobra.Opts().Default(false).Desc("format the text as if paragraphs are reflowed")))
+	addSigilFlags(cmd)
+
+	return
+}
+
+func FmtRunE(cmd *cobra.Command, args []string) error {
+	cobra.Log("beginning fmt cmd")
+	cmd.SilenceUsage = true
+	return reportErrors(formatFiles(cmd, args))
+}
+
+// formatFiles formats the files in args, or stdin if there are none.
+func formatFiles(cmd *cobra.Command, args []string) error {
+	f := newFolio(cmd)
+
+	if len(args) == 0 || len(args) == 1 && args[0] == "-" {
+		cobra.WithField("args", args).Log("reading stdin")
+		in, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		out, err := f.FormatSource("<stdin>", "<stdin>", string(in))
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(out)
+		return nil
+	}
+
+	paths, err := findSources(args)
+	if err != nil {
+		return err
+	}
+
+	check := cobra.GetBool("check")
+	var errs buildErrors
+	unformatted := 0
+
+	for _, path := range paths {
+		changed, err := formatFile(f, path, !check)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if changed {
+			unformatted++
+			if check {
+				fmt.Println(path)
+			}
+		}
+	}
+
+	switch {
+	case len(errs) > 0:
+		return errs
+	case check && unformatted > 0:
+		return fmt.Errorf("%d of %d files aren't formatted", unformatted, len(paths))
+	}
+	return nil
+}
+
+// formatFile formats the file and returns true if the formatted text is
+// different. The file is rewritten only if write is true.
+func formatFile(f *core.Folio, path string, write bool) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := f.FormatSource(filepath.Base(path), path, string(in))
+	if err != nil {
+		return false, err
+	}
+
+	if out == string(in) {
+		return false, nil
+	}
+
+	cobra.WithField("path", path).Add("write", write).Log("file isn't formatted")
+	if write {
+		return true, ioutil.WriteFile(path, []byte(out), info.Mode())
+	}
+	return true, nil
+}
+
+// findSources returns the files named in args, replacing each directory with
+// the .st and .stm files found below it.
+func findSources(args []string) (paths []string, err error) {
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			paths = append(paths, filepath.Clean(arg))
+			continue
+		}
+
+		err = filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			switch filepath.Ext(path) {
+			case ".st", ".stm":
+				if !info.IsDir() {
+					paths = append(paths, path)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
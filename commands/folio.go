@@ -0,0 +1,111 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"path/filepath"
+
+	"github.com/kevinkenan/cobra"
+	"github.com/kevinkenan/subtext/core"
+	"github.com/spf13/pflag"
+)
+
+// newFolio creates a Folio configured from the command's flags. Flags that
+// were explicitly set on the command line override the documents' front
+// matter.
+func newFolio(cmd *cobra.Command) *core.Folio {
+	f := core.NewFolio()
+	f.DefaultWarnings = cobra.GetBool("default-warnings")
+	f.KeepGoing = cobra.GetBool("keep-going")
+
+	for _, pdir := range cobra.GetStringSlice("package-dir") {
+		f.PkgSearchPaths = append(f.PkgSearchPaths, filepath.Clean(pdir))
+	}
+
+	for _, idir := range cobra.GetStringSlice("include-dir") {
+		f.IncludePaths = append(f.IncludePaths, filepath.Clean(idir))
+	}
+	f.ImportRoot = cobra.GetString("import-root")
+
+	if flagSet(cmd, "plain") {
+		plain := cobra.GetBool("plain")
+		f.Overrides.Plain = &plain
+	}
+	if flagSet(cmd, "reflow") {
+		reflow := cobra.GetBool("reflow")
+		f.Overrides.Reflow = &reflow
+	}
+	if flagSet(cmd, "format") {
+		f.Overrides.Format = cobra.GetString("format")
+	}
+
+	// Sigils given on the command line override the front matter while those
+	// from the config file or environment only change the defaults.
+	for fname, sigil := range sigilFlags(&f.Overrides.Sigils) {
+		if flagSet(cmd, fname) {
+			*sigil = cobra.GetString(fname)
+		}
+	}
+	for fname, sigil := range sigilFlags(&f.Sigils) {
+		if !flagSet(cmd, fname) {
+			*sigil = cobra.GetString(fname)
+		}
+	}
+
+	return f
+}
+
+// sigilFlags maps the names of the sigil flags to the sigils they set.
+func sigilFlags(s *core.Sigils) map[string]*string {
+	return map[string]*string{
+		"cmd-sigil":     &s.Cmd,
+		"vcmd-sigil":    &s.VCmd,
+		"comment-sigil": &s.Comment,
+		"par-sigil":     &s.Par,
+	}
+}
+
+// addSigilFlags adds the flags that choose the sigils to cmd.
+func addSigilFlags(cmd *cobra.Command) {
+	cmd.AddFlags(
+		cobra.NewStringFlag("cmd-sigil", cobra.Opts().Desc("sigil that starts a command (default •)")),
+		cobra.NewStringFlag("vcmd-sigil", cobra.Opts().Desc("sigil that starts a vertical-mode command (default §)")),
+		cobra.NewStringFlag("comment-sigil", cobra.Opts().Desc("sigil that starts a comment (default ◊)")),
+		cobra.NewStringFlag("par-sigil", cobra.Opts().Desc("sigil that starts a paragraph control (default ¶)")))
+}
+
+// addImportFlags adds the flags that control where imported files are found
+// to cmd.
+func addImportFlags(cmd *cobra.Command) {
+	cmd.AddFlags(
+		cobra.NewStringSliceFlag("include-dir", cobra.Opts().Desc("path searched for imported files. you may set this multiple times")),
+		cobra.NewStringFlag("import-root", cobra.Opts().Desc("only allow imports of files inside this directory")))
+}
+
+// flagSet returns true if the flag fname was explicitly set on the command
+// line.
+func flagSet(cmd *cobra.Command, fname string) (flagged bool) {
+	if cmd == nil {
+		return
+	}
+
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if flag.Name == fname {
+			flagged = true
+		}
+	})
+
+	return
+}
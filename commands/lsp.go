@@ -0,0 +1,68 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"os"
+
+	"github.com/kevinkenan/cobra"
+	"github.com/kevinkenan/subtext/core"
+	"github.com/kevinkenan/subtext/lsp"
+)
+
+const (
+	lspDesc = `Runs a language server that speaks the Language Server Protocol over stdin
+and stdout. Editors start it to show the problems in .st and .stm files as
+they are edited, to complete macro names, to show a command's parameters,
+and to jump to or describe a macro's definition.
+
+Every document is checked with the packages given by --packages in addition
+to those named in its front matter.
+`
+)
+
+func LSP() (cmd *cobra.Command) {
+	cmd = cobra.NewCommand("lsp")
+	cmd.Short = "run a language server for editors"
+	cmd.Long = lspDesc
+	cmd.RunE = LSPRunE
+	cmd.AddFlags(
+		cobra.NewStringFlag("format", cobra.Opts().Desc("the output format")),
+		cobra.NewStringSliceFlag("packages", cobra.Opts().Abbr("p").Desc("macro package(s) to apply to every document")),
+		cobra.NewStringSliceFlag("package-dir", cobra.Opts().Desc("path to a package directory. you may set this multiple times")))
+	addSigilFlags(cmd)
+	addImportFlags(cmd)
+
+	return
+}
+
+func LSPRunE(cmd *cobra.Command, args []string) error {
+	cobra.Log("beginning lsp cmd")
+	cmd.SilenceUsage = true
+
+	packages := cobra.GetStringSlice("packages")
+	s := lsp.NewServer(os.Stdin, os.Stdout, func() (*core.Folio, error) {
+		f := newFolio(cmd)
+		if len(packages) > 0 {
+			f.Packages = packages
+			if err := f.LoadPackages(packages); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	})
+
+	return s.Serve()
+}
@@ -25,7 +25,7 @@ import (
 
 func Make() (cmd *cobra.Command) {
 	cmd = cobra.NewCommand("make")
-	cmd.Short = "create a new document"
+	cmd.Short = "create a new document from one or more files"
 	cmd.RunE = MakeRunE
 	cmd.AddFlags(
 		cobra.NewStringFlag("output", cobra.Opts().Abbr("o").Default("-").Desc("path to the output file")),
@@ -34,43 +34,63 @@ func Make() (cmd *cobra.Command) {
 		cobra.NewStringFlag("format", cobra.Opts().Desc("the output format")),
 		cobra.NewStringSliceFlag("packages", cobra.Opts().Abbr("p").Desc("macro package(s) to apply to input")),
 		cobra.NewStringSliceFlag("package-dir", cobra.Opts().Desc("path to a package directory. you may set this multiple times")),
+		cobra.NewBoolFlag("watch", cobra.Opts().Default(false).Desc("make the output again when the input changes")),
+		cobra.NewStringFlag("sort", cobra.Opts().Desc("order documents by path, date, title, or a front matter field")),
+		cobra.NewBoolFlag("keep-going", cobra.Opts().Default(false).Desc("report every error instead of stopping at the first")),
 		cobra.NewBoolFlag("default-warnings", cobra.Opts().Default(false).Desc("warn when a default macro is used")))
+	addSigilFlags(cmd)
+	addImportFlags(cmd)
 
 	return
 }
 
 func MakeRunE(cmd *cobra.Command, args []string) error {
 	cobra.Log("beginning make cmd")
-	var err error
 	cmd.SilenceUsage = true
-	var name, path string
-	f := core.NewFolio()
-	f.Cmd = cmd
 
-	for _, pdir := range cobra.GetStringSlice("package-dir") {
-		path = filepath.Clean(pdir)
-		f.PkgSearchPaths = append(f.PkgSearchPaths, path)
+	if !cobra.GetBool("watch") {
+		_, err := makeOutput(cmd, args)
+		return reportErrors(err)
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return fmt.Errorf("watch requires at least one file")
 	}
 
+	roots := append([]string{}, args...)
+	roots = append(roots, cobra.GetStringSlice("package-dir")...)
+
+	return watch(roots, []string{cobra.GetString("output")}, nil, func() ([]string, error) {
+		return makeOutput(cmd, args)
+	})
+}
+
+// makeOutput makes the documents in args and writes the result to the
+// output. It returns the paths of the files used to make the output.
+func makeOutput(cmd *cobra.Command, args []string) (inputs []string, err error) {
+	var name, path string
+	f := newFolio(cmd)
+	f.SortKey = cobra.GetString("sort")
+
 	switch {
-	case len(args) > 1:
-		return fmt.Errorf("make requires zero or one file")
-	case len(args) == 0, args[0] == "-":
+	case len(args) == 0, len(args) == 1 && args[0] == "-":
 		cobra.WithField("args", args).Log("reading stdin")
 
 		// name = "<stdin>"
 		d := core.NewDoc("<stdin>", "<stdin>")
 		if err := f.AppendDoc(d); err != nil {
-			return err
+			return nil, err
 		}
-	case len(args) == 1:
-		cobra.WithField("files", args).Log("reading file")
-		name = args[0]
-		path = filepath.Clean(name)
+	default:
+		cobra.WithField("files", args).Log("reading files")
+		for _, name = range args {
+			path = filepath.Clean(name)
+			inputs = append(inputs, path)
 
-		d := core.NewDoc(name, path)
-		if err := f.AppendDoc(d); err != nil {
-			return err
+			d := core.NewDoc(name, path)
+			if err := f.AppendDoc(d); err != nil {
+				return inputs, err
+			}
 		}
 		// input = append(input, in...)
 	}
@@ -82,13 +102,19 @@ func MakeRunE(cmd *cobra.Command, args []string) error {
 	if len(f.Packages) > 0 {
 		err = f.LoadPackages(f.Packages)
 		if err != nil {
-			return err
+			return inputs, err
 		}
 	}
 
 	output, err := f.MakeDocs()
+
+	inputs = append(inputs, f.PkgFiles...)
+	for _, d := range f.GetDocs() {
+		inputs = append(inputs, d.Imports...)
+	}
+
 	if err != nil {
-		return err
+		return inputs, err
 	}
 	cobra.Log("folio make complete")
 
@@ -97,7 +123,7 @@ func MakeRunE(cmd *cobra.Command, args []string) error {
 	} else {
 		f, err := os.Create(OutputName)
 		if err != nil {
-			return err
+			return inputs, err
 		}
 		defer f.Close()
 
@@ -107,5 +133,5 @@ func MakeRunE(cmd *cobra.Command, args []string) error {
 	// for _, pkg := range d.Packages {
 	// 	fmt.Println(pkg)
 	// }
-	return nil
+	return inputs, nil
 }
@@ -0,0 +1,202 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kevinkenan/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const manifestName = ".subtext-manifest.yaml"
+
+// manifest records the inputs that produced each output of a build so that an
+// incremental build can skip files whose inputs have not changed.
+type manifest struct {
+	path    string
+	Options string                    `yaml:"options"` // build options used for the outputs
+	Entries map[string]*manifestEntry `yaml:"entries"` // keyed by source path
+}
+
+// manifestEntry describes a single output file.
+type manifestEntry struct {
+	Output string            `yaml:"output"` // path to the output file
+	Inputs map[string]string `yaml:"inputs"` // hash of each input file keyed by path
+}
+
+// loadManifest reads the manifest from the output directory. A missing
+// manifest, or one built with different options, yields an empty manifest.
+func loadManifest(outdir, options string) (m *manifest, err error) {
+	m = &manifest{
+		path:    filepath.Join(outdir, manifestName),
+		Options: options,
+		Entries: make(map[string]*manifestEntry),
+	}
+
+	in, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("manifest: %s", err)
+	}
+
+	old := &manifest{}
+	if err = yaml.Unmarshal(in, old); err != nil {
+		return nil, fmt.Errorf("manifest: unable to read %q: %s", m.path, err)
+	}
+
+	if old.Options != options || old.Entries == nil {
+		cobra.Log("build options changed, ignoring manifest")
+		return m, nil
+	}
+
+	m.Entries = old.Entries
+	return m, nil
+}
+
+// save writes the manifest to the output directory. Entries whose source no
+// longer exists are dropped first, and their outputs are removed.
+func (m *manifest) save() error {
+	m.prune()
+
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("manifest: %s", err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fmt.Errorf("manifest: %s", err)
+	}
+
+	if err = ioutil.WriteFile(m.path, out, 0644); err != nil {
+		return fmt.Errorf("manifest: %s", err)
+	}
+
+	return nil
+}
+
+// prune drops the entries whose source has been deleted and removes the
+// files they produced, unless another source now produces the same file.
+func (m *manifest) prune() {
+	live := make(map[string]bool)
+	var gone []string
+	for src, e := range m.Entries {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			gone = append(gone, src)
+		} else {
+			live[e.Output] = true
+		}
+	}
+
+	for _, src := range gone {
+		e := m.Entries[src]
+		delete(m.Entries, src)
+		if live[e.Output] {
+			continue
+		}
+		cobra.WithField("file", e.Output).Log("source was deleted, removing output")
+		if err := os.Remove(e.Output); err != nil && !os.IsNotExist(err) {
+			cobra.WithField("file", e.Output).Logf("unable to remove output: %s", err)
+		}
+	}
+}
+
+// upToDate returns true if src has an entry whose output still exists and
+// whose inputs have not changed. Every path in deps must also be one of the
+// recorded inputs, otherwise a new dependency was added since the last build.
+func (m *manifest) upToDate(src string, deps []string) bool {
+	e, found := m.Entries[src]
+	if !found {
+		return false
+	}
+
+	if _, err := os.Stat(e.Output); err != nil {
+		return false
+	}
+
+	for _, dep := range deps {
+		if _, found := e.Inputs[dep]; !found {
+			return false
+		}
+	}
+
+	for path, hash := range e.Inputs {
+		h, err := fileHash(path)
+		if err != nil || h != hash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// record stores the output produced by src along with the hash of each input.
+func (m *manifest) record(src, output string, inputs []string) error {
+	e := &manifestEntry{
+		Output: output,
+		Inputs: make(map[string]string),
+	}
+
+	for _, path := range inputs {
+		h, err := fileHash(path)
+		if err != nil {
+			return fmt.Errorf("manifest: %s", err)
+		}
+		e.Inputs[path] = h
+	}
+
+	m.Entries[src] = e
+	return nil
+}
+
+// inputs returns the paths of every input recorded in the manifest.
+func (m *manifest) inputs() (paths []string) {
+	seen := make(map[string]bool)
+	for _, e := range m.Entries {
+		for path := range e.Inputs {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return
+}
+
+// fileHash returns the hex encoded SHA-256 hash of the file's contents.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+// writeFiles creates a temporary directory holding the files.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "subtext")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// buildIncremental builds src into out with the manifest and returns the
+// names of the pages that were written.
+func buildIncremental(t *testing.T, src, out, opts string) []string {
+	m, err := loadManifest(out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &siteBuild{folio: core.NewFolio(), outroot: out, manifest: m}
+	if err = b.copyDir(src, out); err != nil {
+		t.Fatal(err)
+	}
+	if errs := b.makeSite(1); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if err = m.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var built []string
+	for _, p := range append(b.pages, b.indexes...) {
+		if !p.upToDate {
+			built = append(built, filepath.Base(p.src))
+		}
+	}
+	sort.Strings(built)
+	return built
+}
+
+func TestIncrementalBuild(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"src/a.st":    "a",
+		"src/b.st":    "b •&(inc.stm)",
+		"src/c.st":    "c",
+		"src/inc.stm": "included",
+	})
+	defer os.RemoveAll(dir)
+
+	src, out := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+	write := func(name, text string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(name string) {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		opts   string
+		exp    []string
+	}{
+		{"first build", func() {}, "x", []string{"a.st", "b.st", "c.st"}},
+		{"nothing changed", func() {}, "x", nil},
+		{"input edited", func() { write("src/a.st", "a2") }, "x", []string{"a.st"}},
+		{"included file edited", func() { write("src/inc.stm", "included2") }, "x", []string{"b.st"}},
+		{"options changed", func() {}, "y", []string{"a.st", "b.st", "c.st"}},
+		{"output missing", func() { remove("out/c.") }, "y", []string{"c.st"}},
+		{"source deleted", func() { remove("src/c.st") }, "y", nil},
+	}
+
+	for _, tc := range tests {
+		tc.change()
+		built := buildIncremental(t, src, out, tc.opts)
+		if fmt.Sprint(built) != fmt.Sprint(tc.exp) {
+			t.Errorf("%s: expected %v to be built, got %v", tc.name, tc.exp, built)
+		}
+	}
+
+	// The deleted source's output and manifest entry are gone.
+	if _, err := os.Stat(filepath.Join(out, "c.")); !os.IsNotExist(err) {
+		t.Errorf("expected the output of the deleted source to be removed, got %v", err)
+	}
+	m, err := loadManifest(out, "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := m.Entries[filepath.Join(src, "c.st")]; found {
+		t.Errorf("expected the deleted source to be dropped from the manifest")
+	}
+	if _, found := m.Entries[filepath.Join(src, "a.st")]; !found {
+		t.Errorf("expected a.st to remain in the manifest")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+// reportErrors prints the problems in err to stderr in the file:line:column
+// format understood by editors and returns an error summarizing them. A nil
+// err is returned unchanged.
+func reportErrors(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	errs := flattenErrors(err)
+	fmt.Fprint(os.Stderr, formatErrors(errs))
+
+	if len(errs) == 1 {
+		return fmt.Errorf("1 error")
+	}
+	return fmt.Errorf("%d errors", len(errs))
+}
+
+// formatErrors formats each error on its own line, followed by the source
+// snippet and macro stack for diagnostics.
+func formatErrors(errs []error) string {
+	b := new(strings.Builder)
+	for _, err := range errs {
+		if d, ok := err.(*core.Diagnostic); ok {
+			b.WriteString(d.Format())
+		} else {
+			fmt.Fprintf(b, "error: %s\n", err)
+		}
+	}
+	return b.String()
+}
+
+// flattenErrors returns the individual errors held by err.
+func flattenErrors(err error) (errs []error) {
+	switch e := err.(type) {
+	case buildErrors:
+		for _, be := range e {
+			errs = append(errs, flattenErrors(be)...)
+		}
+	case core.Diagnostics:
+		for _, d := range e {
+			errs = append(errs, d)
+		}
+	default:
+		errs = append(errs, err)
+	}
+	return
+}
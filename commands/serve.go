@@ -0,0 +1,203 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/kevinkenan/cobra"
+)
+
+const (
+	serveDesc = `Builds the specified directories into a temporary directory and serves the
+result over HTTP. The site is rebuilt when the sources change and HTML pages
+reload themselves after each rebuild.
+`
+
+	// reloadPath is the URL polled by the live reload script.
+	reloadPath = "/_subtext/reload"
+
+	// reloadScript is injected into every HTML page. It polls the server for
+	// the build version and reloads the page when the version changes.
+	reloadScript = `<script>
+(function() {
+  var version = null;
+  function poll() {
+    fetch("` + reloadPath + `").then(function(r) { return r.text(); }).then(function(v) {
+      if (version !== null && v !== version) { location.reload(); return; }
+      version = v;
+      setTimeout(poll, 1000);
+    }).catch(function() { setTimeout(poll, 1000); });
+  }
+  poll();
+})();
+</script>
+`
+)
+
+func Serve() (cmd *cobra.Command) {
+	cmd = cobra.NewCommand("serve")
+	cmd.Short = "build a site and serve it locally"
+	cmd.Long = serveDesc
+	cmd.RunE = ServeRunE
+	cmd.AddFlags(
+		cobra.NewStringFlag("addr", cobra.Opts().Default("localhost:8080").Desc("address for the HTTP server")),
+		cobra.NewStringFlag("jobs", cobra.Opts().Abbr("j").Default("1").Desc("number of files to render at the same time")),
+		cobra.NewBoolFlag("keep-going", cobra.Opts().Default(false).Desc("report every error instead of stopping at the first")),
+		cobra.NewBoolFlag("reflow", cobra.Opts().Default(false).Desc("reflow paragraphs")),
+		cobra.NewStringFlag("format", cobra.Opts().Desc("the output format")),
+		cobra.NewStringSliceFlag("package-dir", cobra.Opts().Desc("path to a package directory. you may set this multiple times")),
+		cobra.NewStringSliceFlag("packages", cobra.Opts().Abbr("p").Desc("macro package(s) to apply to input")))
+	addSigilFlags(cmd)
+	addImportFlags(cmd)
+
+	return
+}
+
+func ServeRunE(cmd *cobra.Command, args []string) (err error) {
+	cobra.Log("beginning serve cmd")
+	cmd.SilenceUsage = true
+
+	if len(args) == 0 {
+		return fmt.Errorf("you must specify a source directory")
+	}
+
+	outdir, err := ioutil.TempDir("", "subtext-serve")
+	if err != nil {
+		return fmt.Errorf("serve: %s", err)
+	}
+	defer os.RemoveAll(outdir)
+	cobra.WithField("dir", outdir).Log("serving from temporary directory")
+
+	s := &server{root: outdir}
+
+	roots := append([]string{}, args...)
+	roots = append(roots, cobra.GetStringSlice("package-dir")...)
+
+	// Pages aren't served while the site is being rebuilt, so a reload
+	// never sees a partly written page.
+	done := make(chan struct{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		watch(roots, []string{outdir}, done, func() ([]string, error) {
+			s.mu.Lock()
+			inputs, err := buildSite(cmd, args, outdir, true)
+			s.mu.Unlock()
+			atomic.AddInt64(&s.version, 1)
+			return inputs, err
+		})
+	}()
+
+	addr := cobra.GetString("addr")
+	srv := &http.Server{Addr: addr, Handler: s}
+
+	// Stop the server on an interrupt so that the deferred removal of the
+	// temporary directory runs.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		<-stop
+		cobra.Log("shutting down the server")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	cobra.Outf("serving at http://%s/", addr)
+	if err = srv.ListenAndServe(); err == http.ErrServerClosed {
+		err = nil
+	}
+
+	// Wait for a rebuild in progress to finish before the temporary
+	// directory is removed.
+	close(done)
+	<-watching
+	return
+}
+
+// server serves the files in root and injects the live reload script into
+// HTML pages.
+type server struct {
+	root    string
+	version int64        // incremented after every build
+	mu      sync.RWMutex // held for writing while the site is built
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == reloadPath {
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, strconv.FormatInt(atomic.LoadInt64(&s.version), 10))
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	upath := path.Clean("/" + req.URL.Path)
+	if path.Base(upath) == manifestName {
+		http.NotFound(w, req)
+		return
+	}
+
+	fpath := filepath.Join(s.root, filepath.FromSlash(upath))
+	if info, err := os.Stat(fpath); err == nil && info.IsDir() {
+		fpath = filepath.Join(fpath, "index.html")
+	}
+
+	if filepath.Ext(fpath) != ".html" {
+		http.FileServer(http.Dir(s.root)).ServeHTTP(w, req)
+		return
+	}
+
+	page, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(injectReloadScript(page))
+}
+
+// injectReloadScript adds the live reload script just before the closing
+// body tag or at the end of the page if there is no body tag.
+func injectReloadScript(page []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if i < 0 {
+		return append(page, reloadScript...)
+	}
+
+	out := new(bytes.Buffer)
+	out.Write(page[:i])
+	out.WriteString(reloadScript)
+	out.Write(page[i:])
+	return out.Bytes()
+}
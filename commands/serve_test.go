@@ -0,0 +1,82 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestInjectReloadScript(t *testing.T) {
+	tests := []struct {
+		name, page, exp string
+	}{
+		{"body tag",
+			"<html><body><p>hi</p></body></html>",
+			"<html><body><p>hi</p>" + reloadScript + "</body></html>"},
+		{"upper case body tag",
+			"<BODY>hi</BODY>",
+			"<BODY>hi" + reloadScript + "</BODY>"},
+		{"no body tag",
+			"<p>hi</p>",
+			"<p>hi</p>" + reloadScript},
+	}
+
+	for _, tc := range tests {
+		out := string(injectReloadScript([]byte(tc.page)))
+		if out != tc.exp {
+			t.Errorf("%s\nExpected: %q\n     Got: %q", tc.name, tc.exp, out)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"index.html":    "<body>home</body>",
+		"style.css":     "body { color: black; }",
+		manifestName:    "entries: {}",
+		"docs/a.html":   "<p>a</p>",
+		"docs/notes.st": "•(ref){x}",
+	})
+	defer os.RemoveAll(dir)
+
+	s := &server{root: dir, version: 3}
+	tests := []struct {
+		path   string
+		status int
+		exp    string
+	}{
+		{"/", 200, "<body>home" + reloadScript + "</body>"},
+		{"/docs/a.html", 200, "<p>a</p>" + reloadScript},
+		{"/style.css", 200, "body { color: black; }"},
+		{"/docs/notes.st", 200, "•(ref){x}"},
+		{"/" + manifestName, 404, ""},
+		{"/missing.html", 404, ""},
+		{reloadPath, 200, "3"},
+	}
+
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, w.Code)
+			continue
+		}
+		if tc.status == 200 && w.Body.String() != tc.exp {
+			t.Errorf("%s\nExpected: %q\n     Got: %q", tc.path, tc.exp, w.Body.String())
+		}
+	}
+}
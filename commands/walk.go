@@ -15,110 +15,143 @@
 package commands
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/kevinkenan/cobra"
 	"github.com/kevinkenan/subtext/core"
 )
 
+const (
+	walkDesc = `Parses the files the same way make does and prints the parse tree instead of
+rendering it. The tree format is an indented outline, json is an array with
+one tree per document, and sexpr prints each document as an s-expression.
+`
+)
+
 func Walk() (cmd *cobra.Command) {
 	cmd = cobra.NewCommand("walk")
-	cmd.Short = "walk the parse tree and print info about each node"
-	cmd.Run = WalkRunE
+	cmd.Short = "print the parse tree of one or more files"
+	cmd.Long = walkDesc
+	cmd.RunE = WalkRunE
+	cmd.AddFlags(
+		cobra.NewStringFlag("output", cobra.Opts().Abbr("o").Default("-").Desc("path to the output file")),
+		cobra.NewStringFlag("format", cobra.Opts().Default("tree").Desc("how to print the parse tree: tree, json, or sexpr")),
+		cobra.NewStringFlag("doc-format", cobra.Opts().Desc("the document's output format")),
+		cobra.NewBoolFlag("plain", cobra.Opts().Default(false).Desc("process the text in plain mode")),
+		cobra.NewBoolFlag("reflow", cobra.Opts().Default(false).Desc("reflow paragraphs")),
+		cobra.NewStringSliceFlag("packages", cobra.Opts().Abbr("p").Desc("macro package(s) to apply to input")),
+		cobra.NewStringSliceFlag("package-dir", cobra.Opts().Desc("path to a package directory. you may set this multiple times")),
+		cobra.NewStringFlag("sort", cobra.Opts().Desc("order documents by path, date, title, or a front matter field")),
+		cobra.NewBoolFlag("keep-going", cobra.Opts().Default(false).Desc("report every error instead of stopping at the first")))
+	addSigilFlags(cmd)
+	addImportFlags(cmd)
+
 	return
 }
 
-func WalkRunE(cmd *cobra.Command, args []string) {
+func WalkRunE(cmd *cobra.Command, args []string) error {
 	cobra.Log("beginning walk cmd")
 	cmd.SilenceUsage = true
-	name := ""
-	var input []byte
-	if len(args) == 0 || args[0] == "-" {
+	return reportErrors(walkOutput(cmd, args))
+}
+
+// walkOutput parses the documents in args and writes their parse trees to
+// the output.
+func walkOutput(cmd *cobra.Command, args []string) (err error) {
+	format := cobra.GetString("format")
+	switch format {
+	case "tree", "json", "sexpr":
+	default:
+		return fmt.Errorf("unknown walk format %q, use tree, json, or sexpr", format)
+	}
+
+	f := newFolio(cmd)
+	f.SortKey = cobra.GetString("sort")
+
+	// The format flag chooses how the tree is printed, so the document's
+	// format comes from doc-format instead.
+	f.Overrides.Format = cobra.GetString("doc-format")
+
+	if len(args) == 0 || len(args) == 1 && args[0] == "-" {
 		cobra.WithField("args", args).Log("reading stdin")
-		name = "<stdin>"
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			in, err := reader.ReadByte()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return
-			}
-			input = append(input, in)
+		args = []string{"<stdin>"}
+	}
+
+	for _, name := range args {
+		path := name
+		if name != "<stdin>" {
+			path = filepath.Clean(name)
 		}
-	} else {
-		cobra.WithField("files", args).Log("reading file")
-		for _, f := range args {
-			name = f
-			in, err := ioutil.ReadFile(f)
-			if err != nil {
-				return
-			}
-			input = in
+
+		d := core.NewDoc(name, path)
+		if err = f.AppendDoc(d); err != nil {
+			return err
 		}
 	}
 
-	f := core.NewFolio()
-	d := core.NewDoc(name, "<stdin>")
-	// d.ParagraphMode = viper.GetBool("paragraph_mode")
-	// if viper.GetBool("paragraph_mode") {
-	// 	d.AddParagraphMacros()
-	// }
-	d.Output = cobra.GetString("output")
-	d.Packages = cobra.GetStringSlice("packages")
-	d.Text = string(input)
-	f.AppendDoc(d)
-	// d.AddMacro(core.NewMacro("paragraph.begin", "<p>", []string{"orig"}, nil))
-	// d.AddMacro(core.NewMacro("paragraph.end", "</p>\n\n", []string{"orig"}, nil))
-	// d.AddMacro(core.NewMacro("title", "<h1>{{.text}}</h1>", []string{"text"}, nil))
-	// d.AddMacro(core.NewMacro("section", "<h2>{{.text}}</h2>", []string{"text"}, nil))
-
-	root, _ := core.Parse(d)
-	c := make(chan core.Node)
-	go root.Walk(c)
-	// fmt.Printf(":: %s\n", root.String())
-	fmt.Printf("> Root Section Node: contains %d nodes\n", len(root.NodeList))
-	for n := range c {
-		switch n.(type) {
-		case *core.Text:
-			fmt.Printf("> Text Node: %q\n", n.(*core.Text).NodeValue)
-		case *core.Section:
-			fmt.Printf("> Section Node: contains %d nodes\n", len(n.(*core.Section).NodeList))
-		case *core.ErrorNode:
-			fmt.Printf("> Error: %q\n", n.(*core.ErrorNode).NodeValue)
-		case *core.Cmd:
-			fmt.Printf("> Cmd Node: %q\n", n.(*core.Cmd).NodeValue)
-			fmt.Printf("     Count: %d nodes\n", n.(*core.Cmd).Count())
-			fmt.Print("     Flags: <")
-			for _, f := range n.(*core.Cmd).Flags {
-				fmt.Printf("%s", f)
-			}
-			fmt.Println(">")
-			fmt.Printf("     Anonymous: %t\n", n.(*core.Cmd).Anonymous)
-			if n.(*core.Cmd).Anonymous {
-				for i, nl := range n.(*core.Cmd).ArgList {
-					fmt.Printf("     Text Block %d:\n", i)
-					for _, nn := range nl {
-						fmt.Printf("       %q\n", nn)
-					}
-				}
-			} else {
-				if len(n.(*core.Cmd).ArgMap) > 0 {
-					for k, v := range n.(*core.Cmd).ArgMap {
-						fmt.Printf("     Argument %q: %s\n", k, v)
-					}
-				} else {
-					fmt.Println("     Arguments: None")
-				}
-			}
-		default:
-			fmt.Printf("> UNEXPECTED Node: %q\n", n.String())
-			fmt.Printf("     Type Code: %d\n", n.Typeof())
+	f.Packages = cobra.GetStringSlice("packages")
+	if len(f.Packages) > 0 {
+		if err = f.LoadPackages(f.Packages); err != nil {
+			return err
 		}
 	}
+
+	var trees []*core.TreeNode
+	var diags core.Diagnostics
+
+	for _, d := range f.GetDocs() {
+		root, err := core.Parse(d)
+		if ds, ok := err.(core.Diagnostics); ok && f.KeepGoing {
+			diags = append(diags, ds...)
+		} else if err != nil {
+			return err
+		}
+		trees = append(trees, core.NewDocTree(d, root))
+	}
+
+	out := new(strings.Builder)
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(trees, "", "  ")
+		if err != nil {
+			return err
+		}
+		out.Write(b)
+		out.WriteString("\n")
+	case "sexpr":
+		for _, t := range trees {
+			out.WriteString(t.SExpr())
+		}
+	default:
+		for _, t := range trees {
+			out.WriteString(t.Tree())
+		}
+	}
+
+	if name := cobra.GetString("output"); name == "-" {
+		fmt.Print(out.String())
+	} else if err = writeFile(name, out.String()); err != nil {
+		return err
+	}
+
+	if len(diags) > 0 {
+		return diags
+	}
+	return nil
+}
+
+// writeFile creates the named file and writes s to it.
+func writeFile(name, s string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(s)
+	return err
 }
@@ -0,0 +1,183 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// watchInterval is how often the watcher polls the file system.
+const watchInterval = 500 * time.Millisecond
+
+// watch calls run and then calls it again each time one of the watched files
+// changes. The watched files are everything below roots and the files
+// returned by run, except for anything below the skip paths. Errors from run
+// are reported but don't end the watch. The watch ends once done is closed
+// and run has returned; a nil done never ends it.
+func watch(roots, skip []string, done <-chan struct{}, run func() ([]string, error)) error {
+	w := newWatcher(roots, skip)
+	cobra.Outf("watching for changes (press ctrl-c to stop)")
+
+	for {
+		// The files are compared with their state before the run, so that a
+		// file saved during the run causes another.
+		before := w.snapshot()
+		files, err := run()
+		if err != nil {
+			fmt.Fprint(os.Stderr, formatErrors(flattenErrors(err)))
+		} else {
+			cobra.Outf("done at %s", time.Now().Format("15:04:05"))
+		}
+
+		w.files = files
+		changed := w.wait(before, done)
+		if changed == nil {
+			return nil
+		}
+		cobra.Outf("changed: %s", strings.Join(changed, ", "))
+	}
+}
+
+// fileState is the part of a file's info used to detect changes.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watcher polls a set of paths for changes.
+type watcher struct {
+	roots []string // directories (or files) to watch recursively
+	skip  []string // paths that are never watched
+	files []string // additional files to watch
+}
+
+func newWatcher(roots, skip []string) *watcher {
+	w := &watcher{}
+
+	for _, r := range roots {
+		w.roots = append(w.roots, filepath.Clean(r))
+	}
+
+	for _, s := range skip {
+		if abs, err := filepath.Abs(s); err == nil {
+			w.skip = append(w.skip, abs)
+		}
+	}
+
+	return w
+}
+
+// wait blocks until a watched file is added, removed or modified since the
+// snapshot and returns the paths that changed. It returns nil if done is
+// closed first.
+func (w *watcher) wait(since map[string]fileState, done <-chan struct{}) []string {
+	current := w.snapshot()
+
+	// Files that weren't watched when the snapshot was taken are compared
+	// from now on.
+	for _, f := range w.files {
+		if _, found := since[f]; !found {
+			if s, found := current[f]; found {
+				since[f] = s
+			}
+		}
+	}
+
+	for {
+		if changed := diffStates(since, current); len(changed) > 0 {
+			return changed
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(watchInterval):
+		}
+		current = w.snapshot()
+	}
+}
+
+// snapshot records the state of every watched file.
+func (w *watcher) snapshot() map[string]fileState {
+	state := make(map[string]fileState)
+
+	for _, r := range w.roots {
+		filepath.Walk(r, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			if w.isSkipped(path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !info.IsDir() {
+				state[path] = fileState{info.ModTime(), info.Size()}
+			}
+
+			return nil
+		})
+	}
+
+	for _, f := range w.files {
+		if info, err := os.Stat(f); err == nil {
+			state[f] = fileState{info.ModTime(), info.Size()}
+		}
+	}
+
+	return state
+}
+
+func (w *watcher) isSkipped(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range w.skip {
+		if abs == s || strings.HasPrefix(abs, s+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diffStates returns the sorted paths that differ between two snapshots.
+func diffStates(old, current map[string]fileState) (changed []string) {
+	for path, s := range current {
+		if o, found := old[path]; !found || !o.modTime.Equal(s.modTime) || o.size != s.size {
+			changed = append(changed, path)
+		}
+	}
+
+	for path := range old {
+		if _, found := current[path]; !found {
+			changed = append(changed, path)
+		}
+	}
+
+	sort.Strings(changed)
+	return
+}
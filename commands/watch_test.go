@@ -0,0 +1,93 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffStates(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Second)
+
+	tests := []struct {
+		name         string
+		old, current map[string]fileState
+		exp          []string
+	}{
+		{"unchanged",
+			map[string]fileState{"a": {t0, 1}, "b": {t0, 2}},
+			map[string]fileState{"a": {t0, 1}, "b": {t0, 2}},
+			nil},
+		{"added",
+			map[string]fileState{"a": {t0, 1}},
+			map[string]fileState{"a": {t0, 1}, "b": {t0, 2}},
+			[]string{"b"}},
+		{"removed",
+			map[string]fileState{"a": {t0, 1}, "b": {t0, 2}},
+			map[string]fileState{"a": {t0, 1}},
+			[]string{"b"}},
+		{"modified time",
+			map[string]fileState{"a": {t0, 1}},
+			map[string]fileState{"a": {t1, 1}},
+			[]string{"a"}},
+		{"modified size",
+			map[string]fileState{"a": {t0, 1}},
+			map[string]fileState{"a": {t0, 5}},
+			[]string{"a"}},
+		{"several",
+			map[string]fileState{"c": {t0, 1}, "b": {t0, 1}, "d": {t0, 1}},
+			map[string]fileState{"a": {t0, 1}, "b": {t0, 1}, "c": {t1, 1}},
+			[]string{"a", "c", "d"}},
+	}
+
+	for _, tc := range tests {
+		changed := diffStates(tc.old, tc.current)
+		if fmt.Sprint(changed) != fmt.Sprint(tc.exp) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.exp, changed)
+		}
+	}
+}
+
+func TestWatchChangeDuringBuild(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"src/a.st": "a",
+		"out/a.":   "a",
+	})
+	defer os.RemoveAll(dir)
+
+	w := newWatcher([]string{dir}, []string{filepath.Join(dir, "out")})
+
+	// The snapshot is taken before the build, so a file saved while the
+	// build runs is reported as soon as the build is done.
+	before := w.snapshot()
+	src := filepath.Join(dir, "src", "a.st")
+	if err := ioutil.WriteFile(src, []byte("a changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "out", "a."), []byte("built"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := w.wait(before, nil)
+	if fmt.Sprint(changed) != fmt.Sprint([]string{src}) {
+		t.Errorf("expected %v to change, got %v", []string{src}, changed)
+	}
+}
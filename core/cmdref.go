@@ -0,0 +1,177 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strings"
+)
+
+// CmdRef describes the command around a location in a document's source. It
+// is meant for editors, which ask about the command under the cursor.
+type CmdRef struct {
+	Name     string // The command's name, which begins with sys. for system commands
+	Begin    int    // Byte offset of the command's sigil
+	End      int    // Byte offset just past the command's name
+	OnName   bool   // True if the location is on the sigil or the name
+	Arg      string // Name of the argument holding the location, if it has one
+	ArgIndex int    // Number of arguments before the location, or -1 if the location isn't in the arguments
+}
+
+// CmdAt returns the innermost command around the byte offset in the
+// document's text, or nil if there isn't one. A location just past a
+// command's name is on the name. Text that can't be scanned is searched up to
+// the problem, so commands that are still being typed are found.
+func CmdAt(d *Document, offset int) *CmdRef {
+	root, _ := ParseSyntax(d)
+	if root == nil {
+		return nil
+	}
+
+	path := syntaxPath(root, offset)
+	if offset > 0 {
+		prev := syntaxPath(root, offset-1)
+		switch {
+		case len(path) == 0:
+			// The location is at the end of the text.
+			path = prev
+		case len(prev) > 0 && prev[len(prev)-1].is(tokenName) && !path[len(path)-1].is(tokenName):
+			path = prev
+		}
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].Kind == SyntaxCmd {
+			return newCmdRef(root, path[i:], offset)
+		}
+	}
+	return nil
+}
+
+// syntaxPath returns the nodes from the root to the leaf that holds the byte
+// offset.
+func syntaxPath(root *SyntaxNode, offset int) []*SyntaxNode {
+	var path []*SyntaxNode
+	pos := 0
+
+	var find func(n *SyntaxNode) bool
+	find = func(n *SyntaxNode) bool {
+		path = append(path, n)
+		if len(n.Children) == 0 {
+			pos += len(n.Text)
+			if offset < pos {
+				return true
+			}
+		}
+		for _, c := range n.Children {
+			if find(c) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if !find(root) {
+		return nil
+	}
+	return path
+}
+
+// syntaxOffset returns the byte offset of n in the source below root.
+func syntaxOffset(root, n *SyntaxNode) int {
+	pos := 0
+	var find func(c *SyntaxNode) bool
+	find = func(c *SyntaxNode) bool {
+		if c == n {
+			return true
+		}
+		pos += len(c.Text)
+		for _, cc := range c.Children {
+			if find(cc) {
+				return true
+			}
+		}
+		return false
+	}
+	find(root)
+	return pos
+}
+
+// newCmdRef describes the command at the start of path, where path leads
+// from the command to the leaf at offset.
+func newCmdRef(root *SyntaxNode, path []*SyntaxNode, offset int) *CmdRef {
+	cmd := path[0]
+	ref := &CmdRef{Begin: syntaxOffset(root, cmd), ArgIndex: -1}
+	ref.End = ref.Begin
+
+	// The sigil, the name, and the parentheses of a system command are the
+	// command's own leaves.
+	named := false
+	for _, c := range cmd.Children {
+		if c.Kind != SyntaxToken && c.Kind != SyntaxTrivia || named && c.Kind != SyntaxTrivia {
+			break
+		}
+		ref.End += len(c.Text)
+		if c.is(tokenName) {
+			ref.Name = cmdName(c.Text)
+			named = true
+		}
+	}
+	if cmd.isSysCmd() && ref.Name != "" {
+		ref.Name = "sys." + ref.Name
+	}
+
+	if len(path) == 2 {
+		ref.OnName = true
+		return ref
+	}
+
+	switch part := path[1]; part.Kind {
+	case SyntaxBlock:
+		// The text block of a short command.
+		ref.ArgIndex = 0
+	case SyntaxContext:
+		ref.ArgIndex = 0
+		for _, c := range part.Children {
+			if c.Kind != SyntaxArg {
+				continue
+			}
+			if len(path) > 2 && c == path[2] {
+				if c.Children[0].is(tokenName) {
+					ref.Arg = cmdName(c.Children[0].Text)
+				}
+				break
+			}
+			if syntaxOffset(root, c) >= offset {
+				break
+			}
+			ref.ArgIndex++
+		}
+	}
+
+	return ref
+}
+
+// cmdName returns the name of a command or argument as written in the
+// source.
+func cmdName(s string) string {
+	switch s {
+	case "'":
+		return "sq"
+	case "\"":
+		return "dq"
+	}
+	return strings.TrimSuffix(s, "*")
+}
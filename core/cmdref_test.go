@@ -0,0 +1,49 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCmdAt(t *testing.T) {
+	tests := []struct {
+		text, at string // the location is just before the first | in text
+		exp      *CmdRef
+	}{
+		{"a •p|air[x={1}] b", "", &CmdRef{Name: "pair", Begin: 2, End: 9, OnName: true, ArgIndex: -1}},
+		{"a •pair|[x={1}] b", "", &CmdRef{Name: "pair", Begin: 2, End: 9, OnName: true, ArgIndex: -1}},
+		{"•pair[x={1} y={|2}]", "", &CmdRef{Name: "pair", End: 7, Arg: "y", ArgIndex: 1}},
+		{"•pair[{1} |{2}]", "", &CmdRef{Name: "pair", End: 7, ArgIndex: 1}},
+		{"•echo{a •em{|b}}", "", &CmdRef{Name: "em", Begin: 10, End: 15, ArgIndex: 0}},
+		{"•(newm|acro){x}", "", &CmdRef{Name: "sys.newmacro", End: 13, OnName: true, ArgIndex: -1}},
+		{"•pair[x={1} y={|", "", &CmdRef{Name: "pair", End: 7, Arg: "y", ArgIndex: 1}},
+		{"plain |text", "", nil},
+	}
+
+	for _, tc := range tests {
+		offset := strings.Index(tc.text, "|")
+		d := NewDoc("test", "test.st")
+		d.Text = tc.text[:offset] + tc.text[offset+1:]
+
+		ref := CmdAt(d, offset)
+		switch {
+		case ref == nil && tc.exp == nil:
+		case ref == nil || tc.exp == nil || *ref != *tc.exp:
+			t.Errorf("%q\nExpected: %+v\n     Got: %+v", tc.text, tc.exp, ref)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// counter is a named number used to number chapters, sections, figures and
+// the like. A counter defined within a parent is reset whenever the parent
+// is stepped, and it is read as the parent's number followed by its own, such
+// as 2.1.3 for a figure within a section within a chapter.
+//
+// Counters belong to the document and begin again each time it is rendered,
+// so its numbers don't depend on which other documents were rendered first,
+// or at the same time. A document that continues the numbering of another
+// sets its counters with resetcounter, such as to its chapter number.
+type counter struct {
+	parent string
+	value  int
+}
+
+// DefineCounter creates the named counter within parent, which may be empty.
+// Defining a counter again with the same parent does nothing, so macros
+// may define the counters they use.
+func (d *Document) DefineCounter(name, parent string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("a counter must have a name")
+	}
+
+	if c, found := d.counters[name]; found {
+		if c.parent != parent {
+			return "", fmt.Errorf("counter %q is already defined within %q", name, c.parent)
+		}
+		return "", nil
+	}
+
+	for p := parent; p != ""; p = d.counters[p].parent {
+		if p == name {
+			return "", fmt.Errorf("counter %q can't be defined within itself", name)
+		}
+		if _, found := d.counters[p]; !found {
+			return "", fmt.Errorf("counter %q is not defined", p)
+		}
+	}
+
+	if d.counters == nil {
+		d.counters = make(map[string]*counter)
+	}
+	d.counters[name] = &counter{parent: parent}
+	cobra.Tag("counter").WithField("name", name).Add("parent", parent).LogV("defined counter")
+	return "", nil
+}
+
+// StepCounter adds one to the named counter and resets the counters defined
+// within it.
+func (d *Document) StepCounter(name string) (string, error) {
+	c, err := d.counter(name)
+	if err != nil {
+		return "", err
+	}
+
+	c.value++
+	d.resetChildren(name)
+	return "", nil
+}
+
+// ResetCounter sets the named counter to value, or to zero if value is
+// empty. The counters defined within it are left alone.
+func (d *Document) ResetCounter(name string, value ...int) (string, error) {
+	c, err := d.counter(name)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(value) {
+	case 0:
+		c.value = 0
+	case 1:
+		c.value = value[0]
+	default:
+		return "", fmt.Errorf("counter %q can't be reset to %d values", name, len(value))
+	}
+	return "", nil
+}
+
+// Counter returns the number of the named counter preceded by the numbers of
+// its parents, separated by dots.
+func (d *Document) Counter(name string) (string, error) {
+	nums := []string{}
+	for p := name; p != ""; p = d.counters[p].parent {
+		c, err := d.counter(p)
+		if err != nil {
+			return "", err
+		}
+		nums = append([]string{strconv.Itoa(c.value)}, nums...)
+	}
+
+	if len(nums) == 0 {
+		return "", fmt.Errorf("a counter must have a name")
+	}
+	return strings.Join(nums, "."), nil
+}
+
+// CounterValue returns the value of the named counter alone.
+func (d *Document) CounterValue(name string) (int, error) {
+	c, err := d.counter(name)
+	if err != nil {
+		return 0, err
+	}
+	return c.value, nil
+}
+
+// counter returns the named counter.
+func (d *Document) counter(name string) (*counter, error) {
+	c, found := d.counters[name]
+	if !found {
+		return nil, fmt.Errorf("counter %q is not defined", name)
+	}
+	return c, nil
+}
+
+// resetChildren sets every counter defined within the named counter, and
+// within those, to zero.
+func (d *Document) resetChildren(name string) {
+	for n, c := range d.counters {
+		if c.parent == name {
+			c.value = 0
+			d.resetChildren(n)
+		}
+	}
+}
+
+// processCounterCmd handles the system commands that define, step, reset and
+// read counters.
+func (r *Render) processCounterCmd(n *Cmd) (items []RenderItem) {
+	name := n.GetCmdName()
+	m := r.getMacro(name, "")
+	if m == nil {
+		r.errorf(n, "system command %q not defined", name)
+	}
+
+	args, err := m.ValidateArgs(n, r.Doc)
+	if err != nil {
+		r.fail(n, err)
+	}
+
+	d := r.Doc
+	counter := strings.TrimSpace(args["name"].String())
+	cobra.Tag("cmd").WithField("syscmd", name).Add("counter", counter).LogV("counter command")
+
+	var s string
+	switch name {
+	case "sys.newcounter":
+		_, err = d.DefineCounter(counter, strings.TrimSpace(args["parent"].String()))
+	case "sys.stepcounter":
+		_, err = d.StepCounter(counter)
+	case "sys.resetcounter":
+		v, verr := strconv.Atoi(strings.TrimSpace(args["value"].String()))
+		if verr != nil {
+			r.errorf(n, "counter value %q isn't a number", args["value"].String())
+		}
+		_, err = d.ResetCounter(counter, v)
+	case "sys.counter":
+		s, err = d.Counter(counter)
+	}
+
+	if err != nil {
+		r.fail(n, err)
+	}
+	if s != "" {
+		items = append(items, r.MakeRenderItem(textItem, s))
+	}
+	return
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	macrodef := `•(newmacro)[def*={
+    name: figure
+    parameters: [label]
+    template: '[[ stepcounter .Doc "figure" ]]Figure [[ counter .Doc "figure" ]]•(refdef)[label={[[ .label ]]} counter={figure}]'
+}*}]`
+	doctext := `•(newcounter){chapter}
+•(newcounter)[name={section} parent={chapter}]
+•(newcounter)[name={figure} parent={section}]
+•(stepcounter){chapter}•(stepcounter){section}
+see •(ref){cat} and •(ref){dog}.
+•figure{cat}
+•figure{bird}
+•(stepcounter){section}
+•figure{dog} in •(counter){section}
+•(resetcounter)[name={chapter} value={4}]•(stepcounter){chapter}
+•(counter){chapter} •(counter){figure}`
+
+	f := NewFolio()
+	if err := f.loadMacros("macrodef", "", macrodef); err != nil {
+		t.Fatalf("loadMacros: unexpected error: %s", err)
+	}
+
+	d := NewDoc("testname", "testpath")
+	d.Text = doctext
+	d.Plain = true
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "\n\n\n\nsee 1.1.1 and 1.2.1.\nFigure 1.1.1\nFigure 1.1.2\n\nFigure 1.2.1 in 1.2\n\n5 5.0.0"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+
+	if v, err := d.CounterValue("figure"); err != nil || v != 0 {
+		t.Errorf("expected figure 0, got %d: %v", v, err)
+	}
+}
+
+func TestCounterErrors(t *testing.T) {
+	tests := []struct {
+		text, exp string
+	}{
+		{"•(stepcounter){nope}", `counter "nope" is not defined`},
+		{"•(newcounter)[name={a} parent={b}]", `counter "b" is not defined`},
+		{"•(newcounter){a}•(newcounter){b}•(newcounter)[name={a} parent={b}]", `counter "a" is already defined within ""`},
+		{"•(newcounter){a}•(resetcounter)[name={a} value={x}]", `counter value "x" isn't a number`},
+		{"•(refdef){a}", `refdef "a" needs a ref or a counter`},
+		{"•(newcounter){a}•(refdef)[label={x} ref={y} counter={a}]", `refdef "x" has both a ref and a counter`},
+	}
+
+	for _, tc := range tests {
+		f := NewFolio()
+		d := NewDoc("testname", "testpath")
+		d.Text = tc.text
+		f.AppendDoc(d)
+
+		_, err := f.MakeDocs()
+		if err == nil || !strings.Contains(err.Error(), tc.exp) {
+			t.Errorf("%q: expected %q, got %v", tc.text, tc.exp, err)
+		}
+	}
+}
+
+func TestCountersPerDocument(t *testing.T) {
+	f := NewFolio()
+	for _, name := range []string{"a", "b"} {
+		d := NewDoc(name, name)
+		d.Text = "•(newcounter){chapter}•(stepcounter){chapter}\nchapter •(counter){chapter}"
+		d.Plain = true
+		f.AppendDoc(d)
+	}
+
+	// Each document numbers its own chapters, and rendering again gives the
+	// same numbers.
+	for i := 0; i < 2; i++ {
+		out, err := f.MakeDocs()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		exp := "\nchapter 1\n\nchapter 1"
+		if out != exp {
+			t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+		}
+	}
+}
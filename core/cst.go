@@ -0,0 +1,301 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SyntaxKind identifies the kind of a SyntaxNode.
+type SyntaxKind int
+
+const (
+	SyntaxFile    SyntaxKind = iota // The whole file
+	SyntaxTrivia                    // Source the scanner skips, such as sigils, front matter, and block comments
+	SyntaxToken                     // Source the scanner turns into a token
+	SyntaxComment                   // A comment and the rest of its line
+	SyntaxCmd                       // A command or system command
+	SyntaxFlags                     // A full command's <...>
+	SyntaxContext                   // A full command's [...]
+	SyntaxArg                       // An argument in a context, with its name if it has one
+	SyntaxBlock                     // A text block, {...}
+)
+
+var syntaxKindNames = []string{"file", "trivia", "token", "comment", "cmd", "flags", "context", "arg", "block"}
+
+func (k SyntaxKind) String() string {
+	return syntaxKindNames[k]
+}
+
+// SyntaxNode is a node of a concrete syntax tree. Unlike the parse tree, it
+// holds every byte of the source, so the source is recovered by joining the
+// text of the leaves.
+type SyntaxNode struct {
+	Kind     SyntaxKind
+	Text     string // The source of a leaf
+	Children []*SyntaxNode
+	tok      tokenType // The token type of a SyntaxToken
+	sys      bool      // True if the node is inside a system command
+}
+
+// String returns the source below the node.
+func (n *SyntaxNode) String() string {
+	b := new(strings.Builder)
+	n.write(b)
+	return b.String()
+}
+
+func (n *SyntaxNode) write(b *strings.Builder) {
+	b.WriteString(n.Text)
+	for _, c := range n.Children {
+		c.write(b)
+	}
+}
+
+// isSysCmd returns true if n is a system command.
+func (n *SyntaxNode) isSysCmd() bool {
+	return n.Kind == SyntaxCmd && len(n.Children) > 0 && n.Children[0].is(tokenSysCmdStart)
+}
+
+// is returns true if n is a token of type t.
+func (n *SyntaxNode) is(t tokenType) bool {
+	return n.Kind == SyntaxToken && n.tok == t
+}
+
+// ParseSyntax returns the concrete syntax tree of the document's text.
+// Imports are not opened. The front matter is kept as trivia. If the text
+// can't be scanned, the tree is returned along with the error, and the source
+// after the problem is kept as trivia in the innermost node still open.
+func ParseSyntax(d *Document) (*SyntaxNode, error) {
+	s := NewScanner(d.Name, d.Text, d.Plain, d)
+	s.path = d.Path
+	s.pos = Loc(d.contentBegin)
+	s.start = Loc(d.contentBegin)
+	s.scanLiterals = true
+	s.noImports = true
+	scanWith(s)
+
+	b := &syntaxBuilder{input: d.Text, scanner: s}
+	b.stack = []*SyntaxNode{{Kind: SyntaxFile}}
+
+	for {
+		t := s.nextToken()
+		switch t.typeof {
+		case tokenError:
+			b.trivia(len(d.Text))
+			return b.stack[0], newDiagnostic(&t, "%s", t.value)
+		case tokenEOF:
+			b.trivia(len(d.Text))
+			return b.stack[0], nil
+		}
+
+		if err := b.add(&t); err != nil {
+			b.trivia(len(d.Text))
+			return b.stack[0], err
+		}
+	}
+}
+
+// syntaxBuilder assembles a concrete syntax tree from the tokens of a scan.
+type syntaxBuilder struct {
+	input   string
+	scanner *scanner
+	stack   []*SyntaxNode // the open nodes, the file first
+	end     int           // the end of the source already in the tree
+	comment bool          // true while the rest of a comment's line is read
+	sys     int           // the number of open system commands
+}
+
+func (b *syntaxBuilder) top() *SyntaxNode {
+	return b.stack[len(b.stack)-1]
+}
+
+func (b *syntaxBuilder) push(k SyntaxKind) {
+	n := &SyntaxNode{Kind: k, sys: b.sys > 0}
+	b.append(n)
+	b.stack = append(b.stack, n)
+}
+
+func (b *syntaxBuilder) pop() {
+	if b.top().isSysCmd() {
+		b.sys--
+	}
+	b.stack = b.stack[:len(b.stack)-1]
+}
+
+func (b *syntaxBuilder) append(n *SyntaxNode) {
+	top := b.top()
+	top.Children = append(top.Children, n)
+}
+
+// trivia adds the source between the end of the last token and end.
+func (b *syntaxBuilder) trivia(end int) {
+	if end > b.end {
+		b.append(&SyntaxNode{Kind: SyntaxTrivia, Text: b.input[b.end:end], sys: b.sys > 0})
+		b.end = end
+	}
+}
+
+// span returns the source of the token. Names and command starts are
+// inserted by the scanner after their source has been skipped, so their
+// source ends where they begin. A system command starts with its sigil and (.
+func (b *syntaxBuilder) span(t *token) (start, end int, err error) {
+	start, end = int(t.loc), int(t.loc)+len(t.value)
+
+	switch t.typeof {
+	case tokenCmdStart:
+		sigil := b.scanner.cmdV
+		if t.value == "H" {
+			sigil = b.scanner.cmdH
+		}
+		start, end = int(t.loc)-len(sigil), int(t.loc)
+	case tokenSysCmdStart:
+		sigil := b.scanner.cmdV
+		if strings.HasSuffix(b.input[:t.loc-1], b.scanner.cmdH) {
+			sigil = b.scanner.cmdH
+		}
+		start = int(t.loc) - 1 - len(sigil)
+	case tokenName:
+		start, end = int(t.loc), int(t.loc)
+		for start > b.end {
+			r, w := utf8.DecodeLastRuneInString(b.input[:start])
+			if !isAlphaNumeric(r) && !strings.ContainsRune("_.-*'\"", r) {
+				break
+			}
+			start -= w
+		}
+	}
+
+	if start < b.end || end > len(b.input) || b.input[start:end] != t.value && t.typeof != tokenCmdStart && t.typeof != tokenSysCmdStart && t.typeof != tokenName {
+		return 0, 0, newDiagnostic(t, "unable to locate %s in the source", tokenTypeLookup(t.typeof))
+	}
+	return
+}
+
+// add places the token in the tree.
+func (b *syntaxBuilder) add(t *token) error {
+	start, end, err := b.span(t)
+	if err != nil {
+		return err
+	}
+
+	// A command without a text block or context ends at the first token
+	// that can't continue it.
+	if top := b.top(); top.Kind == SyntaxCmd && !b.comment {
+		switch t.typeof {
+		case tokenName, tokenLeftSquare, tokenLeftCurly:
+		default:
+			b.pop()
+		}
+	}
+
+	b.trivia(start)
+	leaf := &SyntaxNode{Kind: SyntaxToken, Text: b.input[start:end], tok: t.typeof, sys: b.sys > 0}
+	b.end = end
+
+	// The parser ignores everything after a comment sigil up to and including
+	// the line break.
+	if b.comment {
+		b.append(leaf)
+		if t.typeof == tokenLineBreak {
+			b.comment = false
+			b.pop()
+		}
+		return nil
+	}
+
+	switch t.typeof {
+	case tokenComment:
+		b.push(SyntaxComment)
+		b.append(leaf)
+		b.comment = true
+		return nil
+	case tokenCmdStart:
+		b.push(SyntaxCmd)
+	case tokenSysCmdStart:
+		b.push(SyntaxCmd)
+		b.top().sys = true
+		b.sys++
+	case tokenLeftSquare:
+		b.push(SyntaxContext)
+	case tokenLeftAngle:
+		b.push(SyntaxFlags)
+	case tokenName:
+		if b.top().Kind == SyntaxContext {
+			b.push(SyntaxArg)
+		}
+	case tokenLeftCurly:
+		if b.top().Kind == SyntaxContext {
+			b.push(SyntaxArg)
+		}
+		b.push(SyntaxBlock)
+	case tokenRightSquare:
+		// An argument may be missing its text block.
+		if b.top().Kind == SyntaxArg {
+			b.pop()
+		}
+	}
+
+	leaf.sys = b.sys > 0
+	b.append(leaf)
+
+	switch t.typeof {
+	case tokenRightAngle:
+		return b.close(t, SyntaxFlags)
+	case tokenRightCurly:
+		if err := b.close(t, SyntaxBlock); err != nil {
+			return err
+		}
+		if k := b.top().Kind; k == SyntaxArg || k == SyntaxCmd {
+			b.pop()
+		}
+	case tokenRightSquare:
+		if err := b.close(t, SyntaxContext); err != nil {
+			return err
+		}
+		return b.close(t, SyntaxCmd)
+	}
+
+	return nil
+}
+
+// close ends the open node, which must be of kind k.
+func (b *syntaxBuilder) close(t *token, k SyntaxKind) error {
+	if len(b.stack) < 2 || b.top().Kind != k {
+		return newDiagnostic(t, "unexpected %s", tokenTypeLookup(t.typeof))
+	}
+	b.pop()
+	return nil
+}
+
+// Dump returns an outline of the tree for debugging.
+func (n *SyntaxNode) Dump() string {
+	b := new(strings.Builder)
+	n.dump(b, "")
+	return b.String()
+}
+
+func (n *SyntaxNode) dump(b *strings.Builder, indent string) {
+	if n.Kind == SyntaxToken {
+		fmt.Fprintf(b, "%s%s %q\n", indent, tokenTypeLookup(n.tok), n.Text)
+	} else {
+		fmt.Fprintf(b, "%s%s %q\n", indent, n.Kind, n.Text)
+	}
+	for _, c := range n.Children {
+		c.dump(b, indent+"  ")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Refs, tables of contents and notes are rendered as placeholders that are
+// replaced once every document in the Folio has been rendered. The functions
+// here are shared by each kind of placeholder.
+
+// replacePlaceholders replaces each placeholder in s, which holds a number
+// between open and close, with the text returned by fn. Placeholders with
+// numbers of count or more weren't made by this document and are left alone.
+func replacePlaceholders(s, open, close string, count int, fn func(n int) string) string {
+	out := strings.Builder{}
+
+	for {
+		i := strings.Index(s, open)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i:], close)
+		if j < 0 {
+			break
+		}
+		end := i + j + len(close)
+
+		n, err := strconv.Atoi(s[i+len(open) : i+j])
+		if err != nil || n < 0 || n >= count {
+			out.WriteString(s[:end])
+		} else {
+			out.WriteString(s[:i])
+			out.WriteString(fn(n))
+		}
+		s = s[end:]
+	}
+
+	out.WriteString(s)
+	return out.String()
+}
+
+// renderDeferred renders the text that replaces a placeholder. fn renders as
+// if it were called by the command at tok, so errors are located at the
+// command and show the macro call stack where it was written.
+func (d *Document) renderDeferred(tok *token, stack []string, fn func(r *Render, t *token) string) (s string, err error) {
+	t := &token{}
+	if tok != nil {
+		*t = *tok
+	}
+	t.typeof = tokenCmdStart
+
+	r := &Render{Doc: d, context: append([]string{}, stack...)}
+	defer func() {
+		if e := recover(); e != nil {
+			switch e.(type) {
+			case RenderError, Error, *Diagnostic:
+				s, err = "", r.diagnose(nil, e.(error))
+			default:
+				panic(e)
+			}
+		}
+	}()
+
+	s = fn(r, t)
+	if len(r.diags) > 0 {
+		err = r.diags
+	}
+	return
+}
+
+// generatedCmd creates a command for the named macro with the args it
+// accepts, so that a user's macro may leave out the args it doesn't need.
+func (r *Render) generatedCmd(name string, t *token, args map[string]string) *Cmd {
+	m := r.getMacro(name, r.Doc.Format)
+	if m == nil {
+		r.errorf(nil, "macro %q (format %q) not defined", name, r.Doc.Format)
+	}
+
+	c := NewCmdNode(name, t)
+	c.Format = r.Doc.Format
+	c.Anonymous = false
+	c.ArgMap = NodeMap{}
+	for _, p := range append(append([]string{}, m.Parameters...), m.ListOptions()...) {
+		if v, found := args[p]; found {
+			c.ArgMap[p] = NodeList{NewTextNode(v)}
+		}
+	}
+	return c
+}
+
+// renderGenerated renders the named macro with the args it accepts.
+func (r *Render) renderGenerated(name string, t *token, args map[string]string) string {
+	return r.ConvertRenderItems(r.renderCmd(r.generatedCmd(name, t, args)))
+}
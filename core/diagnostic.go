@@ -0,0 +1,209 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Severity indicates how serious a Diagnostic is.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// Diagnostic describes a problem found while scanning, parsing, or rendering
+// a document.
+type Diagnostic struct {
+	File     string   // Path of the file containing the problem
+	Line     int      // Line number, starting at 1
+	Column   int      // Column in runes, starting at 1
+	Severity Severity //
+	Message  string   //
+	Stack    []string // Macro call stack, outermost first
+	Snippet  string   // The source line containing the problem
+	located  bool     // false if the position is inside generated text
+}
+
+// Error returns the diagnostic on a single line in the form used by
+// compilers: file:line:column: severity: message.
+func (d *Diagnostic) Error() string {
+	switch {
+	case d.File == "":
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	case d.Line == 0:
+		return fmt.Sprintf("%s: %s: %s", d.File, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+}
+
+// Format returns the diagnostic followed by the offending source line with a
+// caret under the column and the macro call stack.
+func (d *Diagnostic) Format() string {
+	b := new(strings.Builder)
+	b.WriteString(d.Error())
+	b.WriteString("\n")
+
+	if d.Snippet != "" {
+		num := fmt.Sprint(d.Line)
+		pad := strings.Repeat(" ", len(num))
+		fmt.Fprintf(b, " %s | %s\n", num, d.Snippet)
+		fmt.Fprintf(b, " %s | %s^\n", pad, caretIndent(d.Snippet, d.Column))
+	}
+
+	if len(d.Stack) > 0 {
+		fmt.Fprintf(b, "    in: %s\n", strings.Join(d.Stack, " > "))
+	}
+
+	return b.String()
+}
+
+// caretIndent returns the whitespace that places a caret under column col of
+// line. Tabs are kept so the caret lines up regardless of tab width.
+func caretIndent(line string, col int) string {
+	b := new(strings.Builder)
+	for i, r := range line {
+		if utf8.RuneCountInString(line[:i]) >= col-1 {
+			break
+		}
+		if r == '\t' {
+			b.WriteRune('\t')
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return b.String()
+}
+
+// Diagnostics is a list of problems. It is returned when more than one
+// problem is found.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	msgs := make([]string, len(ds))
+	for i, d := range ds {
+		msgs[i] = d.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Sort orders the problems by file, line and column, so that they are
+// reported in the order they appear in the source rather than the order they
+// were found. Problems without a location keep their order.
+func (ds Diagnostics) Sort() {
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i], ds[j]
+		switch {
+		case a.File != b.File:
+			return a.File < b.File
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// newDiagnostic creates an error Diagnostic located at the token.
+func newDiagnostic(t *token, format string, args ...interface{}) *Diagnostic {
+	d := &Diagnostic{
+		Severity: SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	d.locate(t)
+	return d
+}
+
+// locate sets the position of the diagnostic to the token's position.
+func (d *Diagnostic) locate(t *token) {
+	if t == nil || t.file == nil || t.file.path == "" {
+		return
+	}
+
+	sf := t.file
+	loc := int(t.loc)
+	if loc > len(sf.input) {
+		loc = len(sf.input)
+	}
+
+	begin := strings.LastIndex(sf.input[:loc], "\n") + 1
+	end := strings.Index(sf.input[loc:], "\n")
+	if end == -1 {
+		end = len(sf.input)
+	} else {
+		end += loc
+	}
+
+	d.File = sf.path
+	d.Line = 1 + strings.Count(sf.input[:loc], "\n")
+	d.Column = 1 + utf8.RuneCountInString(sf.input[begin:loc])
+	d.Snippet = strings.TrimRight(sf.input[begin:end], "\r")
+	d.located = true
+}
+
+// asDiagnostic converts err to a Diagnostic located at the token unless it
+// already is one.
+func asDiagnostic(err error, t *token) *Diagnostic {
+	if d, ok := err.(*Diagnostic); ok {
+		return d
+	}
+	return newDiagnostic(t, "%s", err)
+}
+
+// diagnosticMessage returns the message of err without any location.
+func diagnosticMessage(err error) string {
+	if d, ok := err.(*Diagnostic); ok {
+		return d.Message
+	}
+	return err.Error()
+}
+
+// joinDiagnostics adds the problems in more to those in err. A single
+// problem is returned as it is, and an error that isn't a diagnostic is
+// returned in place of both.
+func joinDiagnostics(err, more error) error {
+	if more == nil {
+		return err
+	}
+	if err == nil {
+		return more
+	}
+
+	var ds Diagnostics
+	for _, e := range []error{err, more} {
+		switch e := e.(type) {
+		case *Diagnostic:
+			ds = append(ds, e)
+		case Diagnostics:
+			ds = append(ds, e...)
+		default:
+			return e
+		}
+	}
+	return ds
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeDiagnostic(t *testing.T, text string) *Diagnostic {
+	f := NewFolio()
+	d := NewDoc("testname", "dir/test.st")
+	d.Text = text
+	f.AppendDoc(d)
+
+	_, err := f.MakeDocs()
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	diag, ok := err.(*Diagnostic)
+	if !ok {
+		t.Fatalf("expected a *Diagnostic, got %T: %s", err, err)
+	}
+	return diag
+}
+
+func TestDiagnosticParse(t *testing.T) {
+	diag := makeDiagnostic(t, "one\n\ttwo •nosuch{x}\n")
+
+	exp := `dir/test.st:2:7: error: command "nosuch" (format "") not defined`
+	if diag.Error() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Error())
+	}
+
+	exp = exp + "\n 2 | \ttwo •nosuch{x}\n   | \t     ^\n"
+	if diag.Format() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Format())
+	}
+}
+
+func TestDiagnosticFrontMatter(t *testing.T) {
+	diag := makeDiagnostic(t, ">>>\ntitle: x\n---\nhello •echo[{a}{b}]")
+
+	if diag.Line != 4 || diag.Column != 8 {
+		t.Errorf("expected 4:8, got %d:%d", diag.Line, diag.Column)
+	}
+
+	if len(diag.Stack) != 1 || diag.Stack[0] != "echo" {
+		t.Errorf("unexpected stack: %v", diag.Stack)
+	}
+}
+
+func TestDiagnosticMacroOutput(t *testing.T) {
+	text := `•(newmacro){
+    name: outer
+    template: "a •inner b"
+}
+x •outer`
+	diag := makeDiagnostic(t, text)
+
+	if diag.File != "dir/test.st" || diag.Line != 5 || diag.Column != 4 {
+		t.Errorf("expected dir/test.st:5:4, got %s:%d:%d", diag.File, diag.Line, diag.Column)
+	}
+
+	if !strings.Contains(diag.Message, `"outer"`) || !strings.Contains(diag.Message, `"inner"`) {
+		t.Errorf("message should name both macros: %q", diag.Message)
+	}
+}
+
+func TestDiagnosticRef(t *testing.T) {
+	diag := makeDiagnostic(t, "x •(ref){nope}")
+
+	exp := `dir/test.st:1:5: error: ref "nope" was not found`
+	if diag.Error() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Error())
+	}
+}
+
+func TestDiagnosticMissingRefs(t *testing.T) {
+	diag := makeDiagnostic(t, "x •echo{•(ref){one}}\n•(ref){two} •(ref){one} •(ref){three}")
+
+	exp := `dir/test.st:1:11: error: 3 refs were not found: "one", "two", "three"`
+	if diag.Error() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Error())
+	}
+}
+
+func TestDiagnosticDuplicateRef(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"0.st":    "•(refdef)[{x}{1}]",
+		"1.st":    "a\n •(refdef)[ref={2} label={x}]",
+		"2.st":    "b •&(defs.st)",
+		"defs.st": "•(refdef)[{x}{3}]",
+	})
+	defer os.RemoveAll(dir)
+
+	f := NewFolio()
+	f.KeepGoing = true
+	for _, name := range []string{"0.st", "1.st", "2.st"} {
+		d := NewDoc(name, filepath.Join(dir, name))
+		if err := d.loadText(); err != nil {
+			t.Fatal(err)
+		}
+		f.AppendDoc(d)
+	}
+
+	_, err := f.MakeDocs()
+	diags, ok := err.(Diagnostics)
+	if !ok || len(diags) != 2 {
+		t.Fatalf("expected two diagnostics, got %T: %v", err, err)
+	}
+
+	// The first is found before rendering and the second, in an imported
+	// file, while rendering.
+	first := filepath.Join(dir, "0.st") + ":1:3"
+	exp := []string{
+		filepath.Join(dir, "1.st") + `:2:4: error: ref "x" is already defined at ` + first,
+		filepath.Join(dir, "defs.st") + `:1:3: error: ref "x" is already defined at ` + first,
+	}
+	for i, diag := range diags {
+		if diag.Error() != exp[i] {
+			t.Errorf("\nExpected: %q\n     Got: %q", exp[i], diag.Error())
+		}
+	}
+}
+
+func TestDiagnosticBlockComment(t *testing.T) {
+	diag := makeDiagnostic(t, "one\ntwo ◊[ three ◊[ four ]◊\n")
+
+	exp := `dir/test.st:2:5: error: block comment is not terminated`
+	if diag.Error() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Error())
+	}
+}
+
+func TestDiagnosticVerbatim(t *testing.T) {
+	diag := makeDiagnostic(t, "one\ntwo •``three`•\n")
+
+	exp := `dir/test.st:2:5: error: verbatim block is not terminated`
+	if diag.Error() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Error())
+	}
+}
+
+func TestDiagnosticScanError(t *testing.T) {
+	diag := makeDiagnostic(t, "one\ntwo •echo[text={1} ! ]\n")
+
+	exp := `dir/test.st:2:20: error: invalid character '!' in command body`
+	if diag.Error() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, diag.Error())
+	}
+}
+
+func TestDiagnosticKeepGoing(t *testing.T) {
+	f := NewFolio()
+	f.KeepGoing = true
+	d := NewDoc("testname", "dir/test.st")
+	d.Text = "a •nosuch{x} b\n\nc •echo[{1}{2}] d\n\ne •echo{f •bad[{g}] h} i\n\nj"
+	d.Plain = true
+	f.AppendDoc(d)
+
+	_, err := f.MakeDocs()
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("expected Diagnostics, got %T: %v", err, err)
+	}
+
+	exp := []string{
+		`dir/test.st:1:4: error: command "nosuch" (format "") not defined`,
+		`dir/test.st:3:4: error: command "echo" contains 1 unknown argument: [#2]`,
+		`dir/test.st:5:12: error: command "bad" (format "") not defined`,
+	}
+	if len(diags) != len(exp) {
+		t.Fatalf("expected %d diagnostics, got %d:\n%s", len(exp), len(diags), diags)
+	}
+	for i, e := range exp {
+		if diags[i].Error() != e {
+			t.Errorf("\nExpected: %q\n     Got: %q", e, diags[i].Error())
+		}
+	}
+
+	for _, s := range []string{"a ", " b", "c ", " d", "e f ", " h i", "j"} {
+		if !strings.Contains(d.Output, s) {
+			t.Errorf("expected %q in the output %q", s, d.Output)
+		}
+	}
+}
+
+func TestDiagnosticKeepGoingScan(t *testing.T) {
+	tests := []struct {
+		text   string
+		exp    []string
+		output []string
+	}{
+		{"a •echo[text={1} ! ] b\n\nc •echo[text={2} ? ] d\n\ne",
+			[]string{
+				`dir/test.st:1:18: error: invalid character '!' in command body`,
+				`dir/test.st:3:18: error: invalid character '?' in command body`,
+			},
+			[]string{"a ", " b", "c ", " d", "e"}},
+		{"a •echo[text={1}\n\nb •nosuch{x} c\n\nd •echo[ ! ]",
+			[]string{
+				`dir/test.st:3:3: error: invalid character '•' in command body`,
+				`dir/test.st:3:4: error: command "nosuch" (format "") not defined`,
+				`dir/test.st:5:10: error: invalid character '!' in command body`,
+			},
+			[]string{"a ", "b ", " c", "d "}},
+	}
+
+	for _, tc := range tests {
+		f := NewFolio()
+		f.KeepGoing = true
+		d := NewDoc("testname", "dir/test.st")
+		d.Text = tc.text
+		d.Plain = true
+		f.AppendDoc(d)
+
+		_, err := f.MakeDocs()
+		diags, ok := err.(Diagnostics)
+		if !ok {
+			t.Fatalf("%q: expected Diagnostics, got %T: %v", tc.text, err, err)
+		}
+		if len(diags) != len(tc.exp) {
+			t.Errorf("%q: expected %d diagnostics, got %d:\n%s", tc.text, len(tc.exp), len(diags), diags)
+			continue
+		}
+		for i, e := range tc.exp {
+			if diags[i].Error() != e {
+				t.Errorf("%q\nExpected: %q\n     Got: %q", tc.text, e, diags[i].Error())
+			}
+		}
+		for _, s := range tc.output {
+			if !strings.Contains(d.Output, s) {
+				t.Errorf("%q: expected %q in the output %q", tc.text, s, d.Output)
+			}
+		}
+	}
+}
@@ -22,19 +22,23 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/kevinkenan/cobra"
 	homedir "github.com/mitchellh/go-homedir"
-	"github.com/spf13/pflag"
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Folio is a collection of documents.
 type Folio struct {
-	Documents       map[DocFile]Document
+	Documents       DocList // Documents in the order they were appended
+	SortKey         string  // How GetDocs orders the documents (see SortDocs)
+	docIndex        map[DocFile]int
 	Data            map[string]interface{}
 	Macros          MacroMap
 	Packages        []string          // The requested list of macro packages
@@ -42,8 +46,20 @@ type Folio struct {
 	PkgSearchPaths  []string          // Where to look for macro packages
 	PkgSearchIndex  int               // Where to begin searching next
 	PkgLocations    map[string]string // Paths to all the known packages
-	Cmd             *cobra.Command    // The CLI command that created the Folio
+	PkgFiles        []string          // Paths to all the loaded package files
+	IncludePaths    []string          // Where to look for imported files not beside the importer
+	ImportRoot      string            // If set, imported files must be inside this directory
+	Overrides       Overrides         // Settings that replace front matter settings
+	DefaultWarnings bool              // Warn when a default macro is used
+	KeepGoing       bool              // Collect every error instead of stopping at the first
+	Sigils          Sigils            // Sigils used unless the front matter chooses others
 	defaultWarnings map[string]bool   // Map of all default macro warnings
+	funcs           template.FuncMap  // Template functions bound to this Folio
+	parses          *parseCache       // Node trees of parsed macro output
+	refDefs         map[string]refDef // Where each ref label is defined
+	refDups         map[refDup]bool   // Repeated ref labels that have been reported
+	folioTOC        bool              // True if a document has a table of contents for the whole Folio
+	mu              sync.RWMutex      // Guards Data, Macros, defaultWarnings, refDefs, refDups and folioTOC
 }
 
 func NewFolio() (f *Folio) {
@@ -55,43 +71,42 @@ func NewFolio() (f *Folio) {
 	userpkg := filepath.Join(userhome, ".subtext", "packages")
 
 	f = &Folio{
-		Documents:       make(map[DocFile]Document),
+		Documents:       DocList{},
+		docIndex:        make(map[DocFile]int),
 		Data:            make(map[string]interface{}),
 		Macros:          NewMacroMap(),
 		Packages:        []string{},
 		LoadedPackages:  make(map[string]bool),
 		PkgSearchPaths:  []string{"packages", userpkg},
+		IncludePaths:    []string{"."},
 		PkgLocations:    make(map[string]string),
 		defaultWarnings: make(map[string]bool),
+		parses:          newParseCache(),
+		refDefs:         make(map[string]refDef),
+		refDups:         make(map[refDup]bool),
 	}
 
-	funcMap["setdata"] = f.SetData
-	funcMap["getdata"] = f.GetData
-	funcMap["indata"] = f.InData
+	f.funcs = f.newFuncMap()
 
 	return
 }
 
-// CheckFlag returns true if the flag fname was explicitly set on the command
-// line.
-func (f *Folio) CheckFlag(fname string) (flagged bool) {
-	if f.Cmd == nil {
-		return
-	}
-
-	f.Cmd.Flags().Visit(func(flag *pflag.Flag) {
-		if flag.Name == fname {
-			flagged = true
-		}
-	})
-
-	return
+// Overrides are settings applied to every document in a Folio, replacing
+// the settings in the document's front matter. Nil fields and an empty Format
+// leave the front matter alone.
+type Overrides struct {
+	Format string
+	Plain  *bool
+	Reflow *bool
+	Sigils Sigils // Non-empty sigils replace those in the front matter
 }
 
-// AppendDoc initializes the document and adds it to the folio.
+// AppendDoc initializes the document and adds it to the folio. If the folio
+// already holds a document with the same name and path, the new document
+// replaces it but keeps its position.
 func (f *Folio) AppendDoc(d *Document) error {
 	if d.Name == "" || d.Path == "" {
-		fmt.Errorf("missing Name or Path when appending doc %q", d.Name)
+		return fmt.Errorf("missing Name or Path when appending doc %q", d.Name)
 	}
 
 	d.Folio = f
@@ -100,7 +115,15 @@ func (f *Folio) AppendDoc(d *Document) error {
 		return err
 	}
 
-	f.Documents[DocFile{FileName: d.Name, FilePath: d.Path}] = *d
+	df := DocFile{FileName: d.Name, FilePath: d.Path}
+	if i, found := f.docIndex[df]; found {
+		f.forgetRefs(f.Documents[i])
+		f.Documents[i] = d
+		return nil
+	}
+
+	f.docIndex[df] = len(f.Documents)
+	f.Documents = append(f.Documents, d)
 	return nil
 }
 
@@ -130,6 +153,13 @@ search:
 			}
 
 			if done {
+				if bp, found := builtinPackage(pkgname); found {
+					if err = f.loadBuiltinPackage(bp); err != nil {
+						return err
+					}
+					f.LoadedPackages[pkgname] = true
+					continue search
+				}
 				cobra.Outf("unable to find package %q", p)
 				continue search
 			}
@@ -246,6 +276,7 @@ func (f *Folio) readMacros(fpath string) (err error) {
 		return
 	}
 
+	f.PkgFiles = append(f.PkgFiles, fpath)
 	return f.loadMacros(fname, fpath, string(fin))
 }
 
@@ -261,74 +292,148 @@ func (f *Folio) loadMacros(fname, fpath, fin string) (err error) {
 	return
 }
 
+// LoadPackageText loads the macros defined in text, the contents of the
+// package file at path, without adding the file to PkgFiles.
+func (f *Folio) LoadPackageText(name, path, text string) error {
+	return f.loadMacros(name, path, text)
+}
+
+// MacroList returns every macro ordered by name and then format.
+func (f *Folio) MacroList() []*Macro {
+	f.mu.RLock()
+	list := make([]*Macro, 0, len(f.Macros))
+	for _, m := range f.Macros {
+		list = append(list, m)
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Format < list[j].Format
+	})
+	return list
+}
+
+// GetMacro returns the named macro. Documents may be rendered concurrently,
+// so use GetMacro rather than accessing Macros directly.
 func (f *Folio) GetMacro(name, format string) (mac *Macro) {
+	f.mu.RLock()
 	mac, found := f.Macros.GetMacro(name, format)
+	f.mu.RUnlock()
 	if mac == nil {
 		return
 	}
 
-	warned := f.defaultWarnings[name]
-	if !found && cobra.GetBool("default-warnings") && !warned {
-		cobra.Outf("warning: default macro used: %q", name)
-		f.defaultWarnings[name] = true
+	if !found && f.DefaultWarnings {
+		f.mu.Lock()
+		if !f.defaultWarnings[name] {
+			cobra.Outf("warning: default macro used: %q", name)
+			f.defaultWarnings[name] = true
+		}
+		f.mu.Unlock()
 	}
 
 	return
 }
 
 func (f *Folio) GetSysMacro(name, format string) (mac *Macro) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	mac, _ = f.Macros.GetMacro(name, format)
 	return
 }
 
 // AddMacro adds a single Macro to the map.
 func (f *Folio) AddMacro(m *Macro) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.Macros.AddMacro(m)
+	f.parses.invalidate()
 }
 
 // AddMacros merges the MacroMap passed as an argument into Folio's MacroMap.
 func (f *Folio) AddMacros(mm MacroMap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.Macros.AddMacros(mm)
+	f.parses.invalidate()
 }
 
+// MakeDocs renders every document in the order given by GetDocs and joins
+// the output.
 func (f *Folio) MakeDocs() (s string, err error) {
 	ds := []string{}
+	var diags Diagnostics
 	// w := new(strings.Builder)
 
-	for _, d := range f.Documents {
-		r := &Render{Doc: &d}
-		var made string
+	err = f.FirstPass()
+	if errs, ok := err.(Diagnostics); ok && f.KeepGoing {
+		diags = append(diags, errs...)
+	} else if err != nil {
+		return
+	}
 
-		made, err = MakeWith(r)
-		if err != nil {
+	docs := f.GetDocs()
+	for _, d := range docs {
+		r := &Render{Doc: d}
+
+		_, err = makeWith(r)
+		if errs, ok := err.(Diagnostics); ok && f.KeepGoing {
+			diags = append(diags, errs...)
+		} else if err != nil {
+			return
+		}
+	}
+
+	// Every refdef and heading in the Folio has been seen, so the refs and
+	// tables of contents can be resolved.
+	for _, d := range docs {
+		err = d.resolveOutput(nil)
+		if diag, ok := err.(*Diagnostic); ok && f.KeepGoing {
+			diags = append(diags, diag)
+		} else if errs, ok := err.(Diagnostics); ok && f.KeepGoing {
+			diags = append(diags, errs...)
+		} else if err != nil {
 			return
 		}
-		ds = append(ds, made)
+		ds = append(ds, d.Output)
 	}
 
 	s = strings.Join(ds, "\n")
+	if len(diags) > 0 {
+		diags.Sort()
+		err = diags
+	}
 	return
 }
 
-// GetDocs returns the Folio's documents in a slice.
+// GetDocs returns the Folio's documents in a slice ordered by SortKey.
 func (f *Folio) GetDocs() (docs []*Document) {
-	for _, d := range f.Documents {
-		docs = append(docs, &d)
-	}
+	docs = make([]*Document, len(f.Documents))
+	copy(docs, f.Documents)
+	DocList(docs).SortDocs(f.SortKey)
 	return
 }
 
 func (f *Folio) SetData(key string, val interface{}) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.Data[key] = val
 	return ""
 }
 
 func (f *Folio) InData(key string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	_, found := f.Data[key]
 	return found
 }
 
 func (f *Folio) GetData(key, dflt string) (interface{}, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	keys := strings.Split(key, ".")
 	var vals interface{}
 	var found bool
@@ -354,6 +459,65 @@ func (f *Folio) GetData(key, dflt string) (interface{}, error) {
 	return vals, nil
 }
 
+// lookupData returns the value stored under key.
+func (f *Folio) lookupData(key string) (val interface{}, found bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	val, found = f.Data[key]
+	return
+}
+
+// copyData returns a shallow copy of Data that templates can read while
+// other documents are being rendered.
+func (f *Folio) copyData() map[string]interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	data := make(map[string]interface{}, len(f.Data))
+	for k, v := range f.Data {
+		data[k] = v
+	}
+	return data
+}
+
+// DocList is an ordered collection of documents.
+type DocList []*Document
+
+// SortDocs orders the documents by the given key. The key may be "path",
+// "date", "title", or the name of any other front matter field. An empty key
+// leaves the documents in insertion order. Other fields compare as numbers
+// when both values are numbers and as strings otherwise. The sort is stable,
+// so documents with equal keys stay in insertion order.
+func (dl DocList) SortDocs(key string) {
+	var less func(a, b *Document) bool
+
+	switch key {
+	case "":
+		return
+	case "path":
+		less = func(a, b *Document) bool { return a.Path < b.Path }
+	case "date":
+		less = func(a, b *Document) bool { return a.Date.Before(b.Date) }
+	case "title":
+		less = func(a, b *Document) bool { return a.Title < b.Title }
+	default:
+		less = func(a, b *Document) bool { return metadataLess(a.Metadata[key], b.Metadata[key]) }
+	}
+
+	sort.SliceStable(dl, func(i, j int) bool { return less(dl[i], dl[j]) })
+}
+
+// metadataLess reports whether front matter value a sorts before b. Values
+// that both parse as numbers compare numerically so that a weight of 2 sorts
+// before a weight of 10.
+func metadataLess(a, b string) bool {
+	x, errx := strconv.ParseFloat(a, 64)
+	y, erry := strconv.ParseFloat(b, 64)
+	if errx == nil && erry == nil {
+		return x < y
+	}
+	return a < b
+}
+
 // DocFile represents the location of a text file to be processed.
 type DocFile struct {
 	FileName string
@@ -363,26 +527,40 @@ type DocFile struct {
 // Document represents a file of text to be processed. The fields are mostly
 // populated from the file's metadata.
 type Document struct {
-	Folio        *Folio            // The folio that contains this document
-	Name         string            // Name of the file
-	Path         string            // The file system path to the file
-	Title        string            // The title of the document
-	OutputName   string            // The name of the output file
-	Template     string            // The name of the wrapper template
-	Date         time.Time         // The date of the document
-	Ignore       bool              // If true, this file is not included in the output
-	Rendered     bool              // True when the document has been rendered and output
-	Packages     []string          // List of packages to add.
-	Output       string            // The rendered output
-	Targets      []string          //
-	Metadata     map[string]string //
-	Text         string            // The raw text of the file
-	contentBegin int               // The index in Text where the config ends and the content begins
-	Initialized  bool              // True if the document has already been initialized
-	Root         *Section          // The root node of the parsed content
-	Plain        bool              // Don't generate paragraphs or aggressively eat whitespace
-	Reflow       bool              // if true, remove new lines and collapse whitespace in paragraphs
-	Format       string            // The format (html, latex, etc.) is used to select the right macro
+	Folio        *Folio              // The folio that contains this document
+	Name         string              // Name of the file
+	Path         string              // The file system path to the file
+	Title        string              // The title of the document
+	OutputName   string              // The name of the output file
+	OutputPath   string              // The output file relative to the output directory when documents are written to separate files
+	Template     string              // The name of the wrapper template
+	Date         time.Time           // The date of the document
+	Ignore       bool                // If true, this file is not included in the output
+	Rendered     bool                // True when the document has been rendered and output
+	Packages     []string            // List of packages to add.
+	Imports      []string            // Files imported while scanning the document
+	Refs         []string            // Paths of the other documents that define the refs in this document
+	Output       string              // The rendered output
+	Targets      []string            //
+	Metadata     map[string]string   // Every front matter field as a string
+	Text         string              // The raw text of the file
+	contentBegin int                 // The index in Text where the config ends and the content begins
+	Initialized  bool                // True if the document has already been initialized
+	Root         *Section            // The root node of the parsed content
+	Plain        bool                // Don't generate paragraphs or aggressively eat whitespace
+	Reflow       bool                // if true, remove new lines and collapse whitespace in paragraphs
+	Format       string              // The format (html, latex, etc.) is used to select the right macro
+	Footnotes    string              // Where footnotes are placed: after each paragraph, or by default at the end of the document
+	Sigils       Sigils              // The sigils that introduce commands, comments, and paragraph controls
+	noPackages   bool                // True if the packages in the front matter aren't loaded
+	definitions  bool                // True if the first pass found a macro or data definition in the text
+	refs         []pendingRef        // The refs resolved after the Folio is rendered
+	tocs         []pendingTOC        // The tables of contents expanded after the Folio is rendered
+	tocEntries   []TOCEntry          // The headings registered for tables of contents
+	notes        []note              // The notes waiting for a flush point
+	noteFlushes  []noteFlush         // The notes rendered after the Folio is rendered
+	noteCounts   map[string]int      // The number of notes of each kind
+	counters     map[string]*counter // Named counters for numbering
 }
 
 // NewDoc creates a new Document and initializes the macrosIn field.
@@ -404,8 +582,10 @@ func (d *Document) initDoc() (err error) {
 		}
 	}
 
+	d.Sigils = d.Folio.Sigils
+
 	if len(d.Text) < 3 || d.Text[:3] != ">>>" {
-		return nil
+		return d.finishInit()
 	}
 
 	confEnd := 3 + strings.Index(d.Text, "---\n")
@@ -420,8 +600,11 @@ func (d *Document) initDoc() (err error) {
 	}
 	cobra.Tag("doc").LogfV("read config for %q", d.Name)
 
+	d.Metadata = make(map[string]string)
+
 	for k, v := range cfg {
 		cobra.Tag("doc").Add("key", k).Add("val", v).LogV("setting config parameter")
+		d.Metadata[fmt.Sprint(k)] = fmt.Sprint(v)
 		// cobra.Set(k.(string), v)
 		switch k {
 		case "reflow":
@@ -438,6 +621,13 @@ func (d *Document) initDoc() (err error) {
 			d.OutputName = v.(string)
 		case "template":
 			d.Template = v.(string)
+		case "footnotes":
+			switch at := fmt.Sprint(v); at {
+			case "paragraph", "document":
+				d.Footnotes = at
+			default:
+				return fmt.Errorf("unable to read config for %q: footnotes must be paragraph or document, not %q", d.Name, at)
+			}
 		case "mode":
 			mode := v.(string)
 			if strings.ToLower(mode) == "plain" {
@@ -448,27 +638,53 @@ func (d *Document) initDoc() (err error) {
 			if err != nil {
 				return err
 			}
+			if d.noPackages {
+				break
+			}
 			err = d.Folio.LoadPackages(d.Packages)
 			if err != nil {
 				return err
 			}
+		case "sigils":
+			sigils, err := readSigils(v)
+			if err != nil {
+				return fmt.Errorf("unable to read config for %q: %s", d.Name, err)
+			}
+			d.Sigils = d.Sigils.merge(sigils)
 		}
 	}
 
-	if d.Folio.CheckFlag("plain") {
-		d.Plain = cobra.GetBool("plain")
-	}
-	if d.Folio.CheckFlag("reflow") {
-		d.Reflow = cobra.GetBool("reflow")
-	}
-	if d.Folio.CheckFlag("format") {
-		d.Format = cobra.GetString("format")
+	return d.finishInit()
+}
+
+// finishInit applies the Folio's overrides and checks the resulting
+// settings.
+func (d *Document) finishInit() error {
+	d.applyOverrides()
+
+	if err := d.Sigils.Validate(); err != nil {
+		return fmt.Errorf("%q: %s", d.Name, err)
 	}
 
 	d.Initialized = true
 	return nil
 }
 
+// applyOverrides replaces the document's settings with the Folio's overrides.
+func (d *Document) applyOverrides() {
+	o := d.Folio.Overrides
+	if o.Plain != nil {
+		d.Plain = *o.Plain
+	}
+	if o.Reflow != nil {
+		d.Reflow = *o.Reflow
+	}
+	if o.Format != "" {
+		d.Format = o.Format
+	}
+	d.Sigils = d.Sigils.merge(o.Sigils)
+}
+
 func (d *Document) loadText() (err error) {
 	var in []byte
 
@@ -499,6 +715,16 @@ func (d *Document) loadText() (err error) {
 	return nil
 }
 
+// addImport records a file imported into the document.
+func (d *Document) addImport(path string) {
+	for _, i := range d.Imports {
+		if i == path {
+			return
+		}
+	}
+	d.Imports = append(d.Imports, path)
+}
+
 func (d *Document) String() string {
 	return d.Title
 }
@@ -548,25 +774,77 @@ func (d *Document) Make() (s string, err error) {
 	return
 }
 
+// MakeDeferred renders the document without resolving its refs, so that they
+// may name labels defined by documents that haven't been rendered yet. Call
+// ResolveRefs once every document has been rendered.
+func (d *Document) MakeDeferred() (s string, err error) {
+	return makeWith(&Render{Doc: d})
+}
+
+// ResolveRefs replaces the refs and tables of contents in the output of
+// MakeDeferred and returns the final output.
+func (d *Document) ResolveRefs() (s string, err error) {
+	err = d.resolveOutput(nil)
+	return d.Output, err
+}
+
 // MakeWith allows arbitrary text to be processed with an existing Render
 // context. Most of the time the Document's Make is used (which calls
 // MakeWith), but MakeWith itself is useful for handling macros embedded in
 // templates.
 func MakeWith(r *Render) (s string, err error) {
+	s, err = makeWith(r)
+	if _, ok := err.(Diagnostics); err != nil && !ok {
+		return
+	}
+	err = r.Doc.resolveOutput(err)
+	if ds, ok := err.(Diagnostics); ok {
+		ds.Sort()
+	}
+	return r.Doc.Output, err
+}
+
+// resolveOutput expands the tables of contents and notes and resolves the
+// refs in the document's output. Their problems are added to the diagnostics in err,
+// which came from rendering the document.
+func (d *Document) resolveOutput(err error) error {
+	d.Refs = nil
+	out, terr := d.expandTOCs(d.Output)
+	out, nerr := d.expandNotes(out)
+	out, rerr := d.resolveRefs(out)
+	d.Output = out
+	return joinDiagnostics(joinDiagnostics(joinDiagnostics(err, terr), nerr), rerr)
+}
+
+// makeWith renders the document leaving its refs unresolved.
+func makeWith(r *Render) (s string, err error) {
 	defer func() { cobra.LogV("finished rendering") }()
 	defer func() {
 		if e := recover(); e != nil {
 			switch e.(type) {
-			case RenderError, Error:
+			case RenderError, Error, *Diagnostic:
 				err = e.(error)
+				if len(r.diags) > 0 {
+					ds := append(r.diags, r.diagnose(nil, err))
+					ds.Sort()
+					err = ds
+				}
 			default:
 				panic(e)
 			}
 		}
 	}()
 
+	r.Doc.refs = nil
+	r.Doc.tocs, r.Doc.tocEntries = nil, nil
+	r.Doc.notes, r.Doc.noteFlushes, r.Doc.noteCounts = nil, nil, nil
+	r.Doc.counters = nil
 	root, err := Parse(r.Doc)
-	if err != nil {
+	if ds, ok := err.(Diagnostics); ok {
+		// The parser recovered, so render what it could and report its errors
+		// along with any found while rendering.
+		r.diags = append(r.diags, ds...)
+	} else if err != nil {
 		return "", err
 	}
 
@@ -576,6 +854,9 @@ func MakeWith(r *Render) (s string, err error) {
 	// out := r.render(root)
 	out := r.renderToString(root)
 
+	// Notes that haven't been placed yet go at the end of the document.
+	out += r.ConvertRenderItems(append(r.flushNotes(nil, footnote), r.flushNotes(nil, endnote)...))
+
 	r.Doc.Output = out
 
 	if r.Doc.Template != "" {
@@ -591,5 +872,10 @@ func MakeWith(r *Render) (s string, err error) {
 
 	r.Doc.Output = out
 	r.Doc.Rendered = true
+
+	if len(r.diags) > 0 {
+		r.diags.Sort()
+		return out, r.diags
+	}
 	return out, nil
 }
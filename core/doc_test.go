@@ -18,8 +18,10 @@ import (
 	"fmt"
 	// "github.com/kevinkenan/subtext/verbose"
 	// "strings"
+	"strings"
+	"testing"
+
 	"github.com/kevinkenan/cobra"
-	// "testing"
 )
 
 func init() {
@@ -36,6 +38,109 @@ func stopFmtComplaints() {
 	fmt.Println("")
 }
 
+// Document Order Tests -------------------------------------------------------
+
+func newOrderTestFolio(t *testing.T) *Folio {
+	f := NewFolio()
+	docs := []struct{ name, text string }{
+		{"b.st", ">>>\ntitle: Beta\nweight: 2\n---\nb"},
+		{"c.st", ">>>\ntitle: Alpha\nweight: 10\n---\nc"},
+		{"a.st", ">>>\ntitle: Gamma\nweight: 1\n---\na"},
+	}
+
+	for _, td := range docs {
+		d := NewDoc(td.name, td.name)
+		d.Text = td.text
+		d.Plain = true
+		if err := f.AppendDoc(d); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	return f
+}
+
+func docNames(docs []*Document) string {
+	names := []string{}
+	for _, d := range docs {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestFolioDocOrder(t *testing.T) {
+	tests := []struct{ key, exp string }{
+		{"", "b.st c.st a.st"},
+		{"path", "a.st b.st c.st"},
+		{"title", "c.st b.st a.st"},
+		{"weight", "a.st b.st c.st"}, // 1, 2, 10: numbers compare numerically
+	}
+
+	for _, test := range tests {
+		f := newOrderTestFolio(t)
+		f.SortKey = test.key
+
+		// Repeat to make sure the order doesn't change between calls.
+		for i := 0; i < 5; i++ {
+			if got := docNames(f.GetDocs()); got != test.exp {
+				t.Errorf("sort %q\nExpected: %q\n     Got: %q", test.key, test.exp, got)
+				break
+			}
+		}
+	}
+}
+
+func TestMetadataLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  bool
+	}{
+		{"2", "10", true},
+		{"10", "2", false},
+		{"-1", "0.5", true},
+		{"2", "2", false},
+		{"b", "a", false},
+		{"10", "a", true},
+		{"a", "10", false},
+	}
+
+	for _, test := range tests {
+		if got := metadataLess(test.a, test.b); got != test.exp {
+			t.Errorf("metadataLess(%q, %q): expected %t, got %t", test.a, test.b, test.exp, got)
+		}
+	}
+}
+
+func TestFolioMakeDocsOrder(t *testing.T) {
+	f := newOrderTestFolio(t)
+	f.SortKey = "title"
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "c\nb\na"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestFolioReplaceDoc(t *testing.T) {
+	f := newOrderTestFolio(t)
+	d := NewDoc("b.st", "b.st")
+	d.Text = "new b"
+	f.AppendDoc(d)
+
+	if got := docNames(f.GetDocs()); got != "b.st c.st a.st" {
+		t.Errorf("unexpected order after replacing a document: %q", got)
+	}
+
+	if f.GetDocs()[0].Text != "new b" {
+		t.Errorf("document was not replaced")
+	}
+}
+
 // Make Test ------------------------------------------------------------------
 
 // func TestMake(t *testing.T) {
@@ -159,3 +264,49 @@ func stopFmtComplaints() {
 // 	r.ParagraphMode = true
 // 	return r
 // }
+
+func TestFolioIsolation(t *testing.T) {
+	a := NewFolio()
+	da := NewDoc("a", "a")
+	da.Text = `•(setdata){greeting: hello}
+•(exec){[[ setdata "name" "world" ]]}
+•(newmacro){
+    name: greet
+    template: '[[ getdata "greeting" "howdy" ]] [[ getdata "name" "nobody" ]]'
+}
+•greet`
+	a.AppendDoc(da)
+
+	b := NewFolio()
+	db := NewDoc("b", "b")
+	db.Text = `•(exec){[[ getdata "greeting" "howdy" ]] [[ getdata "name" "nobody" ]]}`
+	b.AppendDoc(db)
+
+	out, err := a.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "<hello world>\n"
+	if !strings.HasSuffix(out, exp) {
+		t.Errorf("\nExpected suffix: %q\n            Got: %q", exp, out)
+	}
+
+	out, err = b.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp = "howdy nobody"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+
+	if mac := b.GetSysMacro("greet", ""); mac != nil {
+		t.Errorf("macro defined in one Folio is visible in another")
+	}
+
+	if b.InData("greeting") || b.InData("name") {
+		t.Errorf("data set in one Folio is visible in another")
+	}
+}
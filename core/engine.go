@@ -0,0 +1,117 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Options configure an Engine.
+type Options struct {
+	Format          string   // The output format; overrides the front matter when set
+	Plain           bool     // Render in plain mode regardless of the front matter
+	Reflow          bool     // Reflow paragraphs regardless of the front matter
+	Packages        []string // Macro packages loaded before rendering
+	SearchPaths     []string // Directories searched for packages
+	IncludePaths    []string // Directories searched for imported files
+	ImportRoot      string   // If set, imported files must be inside this directory
+	DefaultWarnings bool     // Warn when a default macro is used
+	KeepGoing       bool     // Report every error instead of stopping at the first
+	Sigils          Sigils   // Sigils used unless the front matter chooses others
+}
+
+// Engine renders subtext for programs that embed subtext. It does not
+// depend on the command line. The documents rendered by an Engine share its
+// macros and data, so macros defined in one document are available to the
+// documents rendered after it.
+//
+// An Engine may be used by several goroutines, but it renders one document at
+// a time. It doesn't keep the documents it has rendered.
+type Engine struct {
+	folio *Folio
+	mu    sync.Mutex // Serializes Render, which changes the Folio's macros and data
+}
+
+// NewEngine creates an Engine and loads the packages listed in opts.
+func NewEngine(opts Options) (*Engine, error) {
+	f := NewFolio()
+	f.DefaultWarnings = opts.DefaultWarnings
+	f.KeepGoing = opts.KeepGoing
+	f.Sigils = opts.Sigils
+	f.PkgSearchPaths = append(f.PkgSearchPaths, opts.SearchPaths...)
+	f.IncludePaths = append(f.IncludePaths, opts.IncludePaths...)
+	f.ImportRoot = opts.ImportRoot
+	f.Overrides.Format = opts.Format
+
+	if opts.Plain {
+		f.Overrides.Plain = &opts.Plain
+	}
+
+	if opts.Reflow {
+		f.Overrides.Reflow = &opts.Reflow
+	}
+
+	if len(opts.Packages) > 0 {
+		f.Packages = opts.Packages
+		if err := f.LoadPackages(opts.Packages); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Engine{folio: f}, nil
+}
+
+// Folio returns the Folio holding the Engine's macros and data.
+func (e *Engine) Folio() *Folio {
+	return e.folio
+}
+
+// Render reads the subtext in r and writes the rendered result to w. The
+// name identifies the input in error messages.
+func (e *Engine) Render(name string, r io.Reader, w io.Writer) error {
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("render %q: %s", name, err)
+	}
+
+	if len(input) == 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The document isn't added to the Folio's documents, so a long running
+	// Engine doesn't hold on to every input it has rendered.
+	d := NewDoc(name, name)
+	d.Text = string(input)
+	d.Folio = e.folio
+	if err = d.initDoc(); err != nil {
+		return err
+	}
+	// The labels belong to this input alone.
+	defer e.folio.forgetRefs(d)
+
+	output, err := d.Make()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, output)
+	return err
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEngineRender(t *testing.T) {
+	e, err := NewEngine(Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out := new(strings.Builder)
+	err = e.Render("test", strings.NewReader("•echo{hello}\n\nworld"), out)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "<hello>\n<world>\n"
+	if out.String() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out.String())
+	}
+}
+
+func TestEngineOptions(t *testing.T) {
+	e, err := NewEngine(Options{Format: "html", Plain: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	input := `>>>
+format: latex
+---
+•(newmacro){
+    name: greet
+    format: html
+    template: <b>hello</b>
+}
+•greet`
+
+	out := new(strings.Builder)
+	err = e.Render("test", strings.NewReader(input), out)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "<b>hello</b>"
+	if !strings.HasSuffix(out.String(), exp) {
+		t.Errorf("\nExpected suffix: %q\n            Got: %q", exp, out.String())
+	}
+	if strings.Contains(out.String(), "<\n") {
+		t.Errorf("expected plain output, got %q", out.String())
+	}
+}
+
+func TestEngineSharedMacros(t *testing.T) {
+	e, err := NewEngine(Options{Plain: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	def := "•(newmacro){\n    name: greet\n    template: hello\n}"
+	err = e.Render("def", strings.NewReader(def), new(strings.Builder))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	out := new(strings.Builder)
+	err = e.Render("use", strings.NewReader("•greet"), out)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "hello"
+	if out.String() != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out.String())
+	}
+}
+
+func TestEngineConcurrentRender(t *testing.T) {
+	e, err := NewEngine(Options{Plain: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			out := new(strings.Builder)
+			input := fmt.Sprintf("•(newmacro){\n    name: n%d\n    template: \"%d\"\n}•n%d", i, i, i)
+			if err := e.Render("test", strings.NewReader(input), out); err != nil {
+				errs <- err
+				return
+			}
+			if exp := fmt.Sprint(i); out.String() != exp {
+				errs <- fmt.Errorf("expected %q, got %q", exp, out.String())
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if n := len(e.Folio().Documents); n != 0 {
+		t.Errorf("expected the Engine to keep no documents, it kept %d", n)
+	}
+}
+
+func TestEngineRefsPerRender(t *testing.T) {
+	e, err := NewEngine(Options{Plain: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	input := "see •(ref){a}\n•(refdef)[label={a} ref={A}]"
+	for i := 0; i < 2; i++ {
+		out := new(strings.Builder)
+		if err = e.Render("t.st", strings.NewReader(input), out); err != nil {
+			t.Fatalf("render %d: unexpected error: %s", i+1, err)
+		}
+		if exp := "see A\n"; out.String() != exp {
+			t.Errorf("render %d\nExpected: %q\n     Got: %q", i+1, exp, out.String())
+		}
+	}
+
+	exp := `ref "a" was not found`
+	err = e.Render("z.st", strings.NewReader("see •(ref){a}"), new(strings.Builder))
+	if err == nil || !strings.Contains(err.Error(), exp) {
+		t.Errorf("Expected: %s\n     Got: %v", exp, err)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// argIndent is the indentation of each argument of a context that spans
+// several lines.
+const argIndent = "    "
+
+// FormatSource returns the text of the named file rewritten in the canonical
+// style. Package files, those ending in .stm, are read the way packages are
+// loaded. The front matter of other files is read for the settings that
+// affect the scan, but its packages aren't loaded.
+func (f *Folio) FormatSource(name, path, text string) (string, error) {
+	d := NewDoc(name, path)
+	d.Text = text
+	d.Folio = f
+
+	if filepath.Ext(path) == ".stm" {
+		d.Plain = true
+	} else {
+		d.noPackages = true
+		if err := d.initDoc(); err != nil {
+			return "", err
+		}
+	}
+
+	return Format(d)
+}
+
+// Format returns the document's text rewritten in the canonical style, which
+// changes only what doesn't affect the output:
+//
+//   - Flags immediately follow the [ of a context, with no spaces.
+//   - A context written on one line is kept on one line with a single space
+//     before each named argument and none before a positional one.
+//   - A context written on several lines puts each argument on its own line,
+//     indented four spaces past the line that holds the command, and the
+//     closing ] on a line of its own.
+//   - Trailing spaces and tabs are removed from comments, from the text of
+//     package files outside of commands, and, when the document is reflowed,
+//     from text outside of system commands, except text that follows a
+//     block comment on its line.
+//
+// Contexts that hold comments are left as they are. Formatting formatted text
+// doesn't change it.
+func Format(d *Document) (string, error) {
+	root, err := ParseSyntax(d)
+	if err != nil {
+		return "", err
+	}
+
+	f := &formatter{trim: make(map[*SyntaxNode]bool)}
+	f.findTrailing(root, d.Reflow, filepath.Ext(d.Path) == ".stm")
+	f.node(root)
+	return f.b.String(), nil
+}
+
+// formatter writes a concrete syntax tree in the canonical style.
+type formatter struct {
+	b    strings.Builder
+	trim map[*SyntaxNode]bool // text leaves whose trailing spaces are removed
+}
+
+// findTrailing marks the text leaves that end a line and whose trailing
+// spaces don't reach the output.
+func (f *formatter) findTrailing(root *SyntaxNode, reflow, pkg bool) {
+	var prev *SyntaxNode
+	var prevSafe bool
+	var afterTrivia bool // a block comment or sigil precedes n on its line
+
+	var walk func(n *SyntaxNode, inCmd, inComment bool)
+	walk = func(n *SyntaxNode, inCmd, inComment bool) {
+		switch n.Kind {
+		case SyntaxCmd:
+			inCmd = true
+		case SyntaxComment:
+			inComment = true
+		}
+
+		if len(n.Children) == 0 {
+			if prev != nil && prevSafe && n.is(tokenLineBreak) {
+				f.trim[prev] = true
+			}
+			// Trimming the text that follows a block comment changes how a
+			// reflowed line ends, so that text is left as it is.
+			switch {
+			case n.Kind == SyntaxTrivia:
+				afterTrivia = !strings.HasSuffix(n.Text, "\n")
+			case n.is(tokenLineBreak):
+				afterTrivia = false
+			}
+			prev = n
+			prevSafe = (n.is(tokenText) || n.is(tokenEmptyLine)) &&
+				(inComment || !afterTrivia && !n.sys && (reflow || pkg && !inCmd))
+			return
+		}
+
+		for _, c := range n.Children {
+			walk(c, inCmd, inComment)
+		}
+	}
+
+	walk(root, false, false)
+}
+
+func (f *formatter) node(n *SyntaxNode) {
+	switch {
+	case n.Kind == SyntaxContext && n.canFormat():
+		f.context(n)
+	case f.trim[n]:
+		f.b.WriteString(strings.TrimRight(n.Text, " \t"))
+	default:
+		f.b.WriteString(n.Text)
+		for _, c := range n.Children {
+			f.node(c)
+		}
+	}
+}
+
+// context writes a context in the canonical layout.
+func (f *formatter) context(n *SyntaxNode) {
+	var flags string
+	var args []*SyntaxNode
+	multiline := false
+
+	for _, c := range n.Children {
+		switch {
+		case c.Kind == SyntaxFlags:
+			flags = c.flagText()
+		case c.Kind == SyntaxArg:
+			args = append(args, c)
+		case c.is(tokenLineBreak):
+			multiline = true
+		}
+	}
+
+	f.b.WriteString("[" + flags)
+	if len(args) == 0 {
+		f.b.WriteString("]")
+		return
+	}
+
+	indent := f.lineIndent()
+	for i, arg := range args {
+		named := arg.Children[0].is(tokenName)
+		switch {
+		case multiline:
+			f.b.WriteString("\n" + indent + argIndent)
+		case i > 0 && named:
+			f.b.WriteString(" ")
+		}
+
+		if named {
+			f.b.WriteString(arg.Children[0].Text + "=")
+		}
+		f.node(arg.Children[len(arg.Children)-1])
+	}
+
+	if multiline {
+		f.b.WriteString("\n" + indent)
+	}
+	f.b.WriteString("]")
+}
+
+// lineIndent returns the spaces and tabs that begin the last line written.
+func (f *formatter) lineIndent() string {
+	s := f.b.String()
+	line := s[strings.LastIndex(s, "\n")+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// flagText returns the flags without spaces.
+func (n *SyntaxNode) flagText() string {
+	b := new(strings.Builder)
+	for _, c := range n.Children {
+		if c.Kind == SyntaxToken {
+			b.WriteString(c.Text)
+		}
+	}
+	return b.String()
+}
+
+// canFormat returns true if the context holds nothing but flags, arguments,
+// and the spaces between them, so that changing its layout doesn't lose
+// anything.
+func (n *SyntaxNode) canFormat() bool {
+	last := len(n.Children) - 1
+	if last < 1 || !n.Children[0].is(tokenLeftSquare) || !n.Children[last].is(tokenRightSquare) {
+		return false
+	}
+
+	first := true // true until something other than space is seen
+	for _, c := range n.Children[1:last] {
+		switch {
+		case c.Kind == SyntaxFlags:
+			// The parser only finds flags on the same line as the [ and
+			// before any argument.
+			if !first {
+				return false
+			}
+		case c.Kind == SyntaxArg:
+			if !c.isSimpleArg() {
+				return false
+			}
+		case c.is(tokenLineBreak):
+			first = false
+		case c.isSpace():
+		default:
+			return false
+		}
+		if !c.isSpace() {
+			first = false
+		}
+	}
+
+	return true
+}
+
+// isSimpleArg returns true if the argument is a text block, possibly preceded
+// by a name and =.
+func (n *SyntaxNode) isSimpleArg() bool {
+	var parts []*SyntaxNode
+	for _, c := range n.Children {
+		if !c.isSpace() {
+			parts = append(parts, c)
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		return parts[0].Kind == SyntaxBlock && len(n.Children) == 1
+	case 3:
+		return parts[0].is(tokenName) && parts[1].is(tokenEqual) && parts[2].Kind == SyntaxBlock &&
+			n.Children[0] == parts[0] && n.Children[len(n.Children)-1] == parts[2]
+	}
+	return false
+}
+
+// isSpace returns true if the node is nothing but white space.
+func (n *SyntaxNode) isSpace() bool {
+	switch {
+	case n.Kind == SyntaxTrivia:
+		return strings.Trim(n.Text, spaceChars) == ""
+	case n.Kind == SyntaxToken:
+		return n.tok == tokenLineBreak || n.tok == tokenIndent || n.tok == tokenEmptyLine
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+// formatMacros defines the macros used by the format tests.
+const formatMacros = `•(newmacro){
+    name: pair
+    parameters: [a, b]
+    template: "<[[.a]]|[[.b]]>"
+}
+•(newmacro){
+    name: pos
+    parameters: [a, b]
+    template: "([[.a]],[[.b]])"
+}
+`
+
+var formatTests = []struct {
+	name, input, exp string
+	reflow           bool
+}{
+	{"named args on one line",
+		"•pair[a={x}   b={y}]\n",
+		"•pair[a={x} b={y}]\n", false},
+	{"named args without spaces",
+		"•pair[a={x}b={y}]\n",
+		"•pair[a={x} b={y}]\n", false},
+	{"spaces around equals",
+		"•pair[a = {x} b =\t{y}]\n",
+		"•pair[a={x} b={y}]\n", false},
+	{"positional args",
+		"•pos[ {x}  {y} ]\n",
+		"•pos[{x}{y}]\n", false},
+	{"named args on several lines",
+		"•pair[a={x}\n  b={y}]\n",
+		"•pair[\n    a={x}\n    b={y}\n]\n", false},
+	{"nested contexts",
+		"  •pair[a={•pair[b={1}\na={2}]}\n b={y}]\n",
+		"  •pair[\n      a={•pair[\n          b={1}\n          a={2}\n      ]}\n      b={y}\n  ]\n", false},
+	{"flags",
+		"•pair[ < a , b > a={x} b={y}]\n",
+		"•pair[<a,b>a={x} b={y}]\n", false},
+	{"empty context",
+		"•pair[  ]\n",
+		"•pair[]\n", false},
+	{"context with a comment",
+		"•pair[a={x} ◊ note\n  b={y}]\n",
+		"•pair[a={x} ◊ note\n  b={y}]\n", false},
+	{"trailing space in comment",
+		"text ◊ note   \nmore\n",
+		"text ◊ note\nmore\n", false},
+	{"trailing space kept",
+		"text   \nmore\n",
+		"text   \nmore\n", false},
+	{"alt terminator and space eater",
+		"•pair[a*={x}}*}  b={y}]%   \ntext\n",
+		"•pair[a*={x}}*} b={y}]%   \ntext\n", false},
+	{"trailing space after a block comment",
+		"text ◊[ block\ncomment ]◊   \nmore   \n",
+		"text ◊[ block\ncomment ]◊   \nmore\n", true},
+}
+
+func formatTestDoc(text string, reflow bool) *Document {
+	f := NewFolio()
+	d := NewDoc("testname", "testpath")
+	d.Text = text
+	d.Reflow = reflow
+	d.Folio = f
+	return d
+}
+
+func TestFormat(t *testing.T) {
+	for _, tc := range formatTests {
+		out, err := Format(formatTestDoc(tc.input, tc.reflow))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		if out != tc.exp {
+			t.Errorf("%s\nExpected: %q\n     Got: %q", tc.name, tc.exp, out)
+		}
+
+		again, err := Format(formatTestDoc(out, tc.reflow))
+		if err != nil || again != out {
+			t.Errorf("%s: formatting is not idempotent\nFirst: %q\n Next: %q (%v)", tc.name, out, again, err)
+		}
+
+		before, berr := renderFormatTest(tc.input, tc.reflow)
+		after, aerr := renderFormatTest(out, tc.reflow)
+		if before != after || fmt.Sprint(berr) != fmt.Sprint(aerr) {
+			t.Errorf("%s: formatting changed the output\nBefore: %q (%v)\n After: %q (%v)", tc.name, before, berr, after, aerr)
+		}
+	}
+}
+
+func TestFormatReflow(t *testing.T) {
+	input := "•(newmacro){\n    name: x   \n    template: \"y\"\n}\nOne   \ntwo\t\n\n•pos[{a  \nb}{c}]\n"
+	exp := "•(newmacro){\n    name: x   \n    template: \"y\"\n}\nOne\ntwo\n\n•pos[{a\nb}{c}]\n"
+
+	out, err := Format(formatTestDoc(input, true))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestFormatPackage(t *testing.T) {
+	input := "•(newmacro){\n    name: x   \n    template: \"y\"\n}   \n•pos[{a  \nb}{c}]  \n"
+	exp := "•(newmacro){\n    name: x   \n    template: \"y\"\n}\n•pos[{a  \nb}{c}]\n"
+
+	d := formatTestDoc(input, false)
+	d.Path = "pkg.stm"
+	d.Plain = true
+	out, err := Format(d)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+// TestSyntaxRoundTrip checks that the concrete syntax tree holds every byte
+// of the scanner's test inputs.
+func TestSyntaxRoundTrip(t *testing.T) {
+	cases := append(append([]testCase{}, commonTestCases...), plainParTestCases...)
+	for _, tc := range cases {
+		if last := tc.exp[len(tc.exp)-1]; last.typeof == tokenError {
+			continue
+		}
+
+		for _, plain := range []bool{true, false} {
+			d := formatTestDoc(tc.input, false)
+			d.Plain = plain
+			root, err := ParseSyntax(d)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err)
+				continue
+			}
+			if root.String() != tc.input {
+				t.Errorf("%s\nExpected: %q\n     Got: %q", tc.name, tc.input, root.String())
+			}
+		}
+	}
+}
+
+// TestFormatOutput checks that formatting doesn't change the output.
+func TestFormatOutput(t *testing.T) {
+	docs := []string{
+		"Some text   \nmore text\n\n•pair[a={x}\n   b={•pos[{1}   {2}]}]  \n\nend  \n",
+		"•pair[\n    b*={}}*}\n a={x}\n]% \n  indented\n\t\n•pair[<f>a={x} b={y}]\n",
+		"◊ comment  \n•pos[{•pair[a={p}\nb={q}]} {z}]",
+	}
+
+	for _, text := range docs {
+		for _, reflow := range []bool{false, true} {
+			d := formatTestDoc(text, reflow)
+			formatted, err := Format(d)
+			if err != nil {
+				t.Errorf("unexpected error formatting %q: %s", text, err)
+				continue
+			}
+
+			before, err := renderFormatTest(text, reflow)
+			if err != nil {
+				t.Errorf("unexpected error rendering %q: %s", text, err)
+				continue
+			}
+			after, err := renderFormatTest(formatted, reflow)
+			if err != nil {
+				t.Errorf("unexpected error rendering %q: %s", formatted, err)
+				continue
+			}
+			if before != after {
+				t.Errorf("formatting %q changed the output (reflow %v)\nBefore: %q\n After: %q", text, reflow, before, after)
+			}
+		}
+	}
+}
+
+func renderFormatTest(text string, reflow bool) (string, error) {
+	f := NewFolio()
+	if err := f.loadMacros("format.stm", "format.stm", formatMacros); err != nil {
+		return "", err
+	}
+	if reflow {
+		f.Overrides.Reflow = &reflow
+	}
+
+	d := NewDoc("testname", "testpath")
+	d.Text = text
+	if err := f.AppendDoc(d); err != nil {
+		return "", err
+	}
+	return f.MakeDocs()
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"text/template"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// MacroFunc implements a macro in Go. The returned text is handled like the
+// output of a template, so it may contain other commands.
+type MacroFunc func(r *Render, args *MacroArgs) (string, error)
+
+// NodeFunc implements a macro in Go that builds the nodes to render directly
+// instead of returning text to be parsed.
+type NodeFunc func(r *Render, args *MacroArgs) (NodeList, error)
+
+// MacroArgs holds the validated arguments passed to a Go macro.
+type MacroArgs struct {
+	Cmd   *Cmd              // The command that invoked the macro
+	Nodes NodeMap           // The arguments as parsed nodes
+	Text  map[string]string // The arguments rendered to text
+}
+
+// Get returns the rendered text of the named argument.
+func (a *MacroArgs) Get(name string) string {
+	return a.Text[name]
+}
+
+// HasFlag returns true if the command was given the flag.
+func (a *MacroArgs) HasFlag(flag string) bool {
+	return a.Cmd.HasFlag(flag)
+}
+
+// NewFuncMacro creates a macro implemented by fn.
+func NewFuncMacro(name string, params []string, optionals []*Optional, fn MacroFunc) *Macro {
+	return &Macro{
+		Name:       name,
+		Parameters: params,
+		Optionals:  optionals,
+		Func:       fn,
+		Ld:         "[[",
+		Rd:         "]]"}
+}
+
+// NewNodeMacro creates a macro implemented by fn.
+func NewNodeMacro(name string, params []string, optionals []*Optional, fn NodeFunc) *Macro {
+	return &Macro{
+		Name:       name,
+		Parameters: params,
+		Optionals:  optionals,
+		NodeFunc:   fn,
+		Ld:         "[[",
+		Rd:         "]]"}
+}
+
+// isGoMacro returns true if the macro is implemented in Go.
+func (m *Macro) isGoMacro() bool {
+	return m.Func != nil || m.NodeFunc != nil
+}
+
+// executeGoMacro calls the Go function that implements the macro and returns
+// the nodes to render.
+func (r *Render) executeGoMacro(m *Macro, args *MacroArgs) (*Section, error) {
+	if m.NodeFunc != nil {
+		nl, err := m.NodeFunc(r, args)
+		if err != nil {
+			return nil, err
+		}
+		output := NewSection()
+		output.append(nl)
+		return output, nil
+	}
+
+	s, err := m.Func(r, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMacro(m.Name, s, r.Doc, r.depth)
+}
+
+// Package is a macro package compiled into the program. Built-in packages
+// are loaded with LoadPackages just like packages found on disk, but a
+// package on disk with the same name takes precedence.
+type Package struct {
+	Name   string   // The name used to request the package
+	Source string   // Macro definitions written in subtext, as in a .stm file
+	Macros []*Macro // Macros implemented in Go
+}
+
+var (
+	builtinMu       sync.RWMutex
+	builtinPackages = map[string]*Package{}
+)
+
+// RegisterPackage makes a built-in package available to every Folio. It is
+// meant to be called from an init function and panics if a package with the
+// same name is already registered.
+func RegisterPackage(p *Package) {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+
+	if _, found := builtinPackages[p.Name]; found {
+		panic(fmt.Sprintf("package %q registered twice", p.Name))
+	}
+	builtinPackages[p.Name] = p
+}
+
+// BuiltinPackages returns the names of the registered built-in packages.
+func BuiltinPackages() (names []string) {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+
+	for name := range builtinPackages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func builtinPackage(name string) (p *Package, found bool) {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	p, found = builtinPackages[name]
+	return
+}
+
+// loadBuiltinPackage adds the package's macros to the Folio. Each Folio gets
+// its own copy of the macros, so a change made in one Folio isn't seen by
+// others.
+func (f *Folio) loadBuiltinPackage(p *Package) error {
+	for _, m := range p.Macros {
+		f.AddMacro(m.clone())
+	}
+
+	if p.Source != "" {
+		err := f.loadMacros(p.Name+".stm", "<builtin>/"+p.Name+".stm", p.Source)
+		if err != nil {
+			return fmt.Errorf("package %q: %s", p.Name, err)
+		}
+	}
+
+	cobra.Tag("doc").WithField("package", p.Name).LogV("loaded built-in package")
+	return nil
+}
+
+// clone returns a copy of the macro that shares nothing with it that can be
+// changed.
+func (m *Macro) clone() *Macro {
+	c := *m
+	c.Parameters = append([]string(nil), m.Parameters...)
+	c.Optionals = make([]*Optional, len(m.Optionals))
+	for i, o := range m.Optionals {
+		opt := *o
+		c.Optionals[i] = &opt
+	}
+	if m.Template != nil {
+		c.Template = template.Must(m.Template.Clone())
+	}
+	if m.InitTemplate != nil {
+		c.InitTemplate = template.Must(m.InitTemplate.Clone())
+	}
+	if m.Pos != nil {
+		pos := *m.Pos
+		c.Pos = &pos
+	}
+	return &c
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoMacroFunc(t *testing.T) {
+	f := NewFolio()
+	f.AddMacro(NewFuncMacro("shout", []string{"text"}, nil, func(r *Render, args *MacroArgs) (string, error) {
+		return strings.ToUpper(args.Get("text")) + " •echo{done}", nil
+	}))
+
+	d := NewDoc("testname", "testpath")
+	d.Text = "•shout{hello •echo{world}}"
+	d.Plain = true
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "HELLO WORLD done"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestGoMacroNodes(t *testing.T) {
+	f := NewFolio()
+	f.AddMacro(NewNodeMacro("twice", []string{"text"}, nil, func(r *Render, args *MacroArgs) (NodeList, error) {
+		nl := append(NodeList{}, args.Nodes["text"]...)
+		nl = append(nl, NewTextNode("/"))
+		return append(nl, args.Nodes["text"]...), nil
+	}))
+
+	d := NewDoc("testname", "testpath")
+	d.Text = "•twice{•echo{a}}"
+	d.Plain = true
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "a/a"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+// The registry is global and panics on a second registration, so the test
+// package is registered once for every run of the tests.
+func init() {
+	RegisterPackage(&Package{
+		Name: "testbuiltin",
+		Source: `•(newmacro){
+    name: greet
+    template: hello
+}`,
+		Macros: []*Macro{NewFuncMacro("who", nil, nil, func(r *Render, args *MacroArgs) (string, error) {
+			return "world", nil
+		})},
+	})
+}
+
+func TestBuiltinPackage(t *testing.T) {
+	f := NewFolio()
+	f.PkgSearchPaths = nil
+	if err := f.LoadPackages([]string{"testbuiltin"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d := NewDoc("testname", "testpath")
+	d.Text = "•greet •who"
+	d.Plain = true
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "hello world"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestBuiltinPackageCopies(t *testing.T) {
+	f1, f2 := NewFolio(), NewFolio()
+	for _, f := range []*Folio{f1, f2} {
+		f.PkgSearchPaths = nil
+		if err := f.LoadPackages([]string{"testbuiltin"}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	f1.GetMacro("who", "").Block = true
+	if f2.GetMacro("who", "").Block {
+		t.Errorf("a change to a built-in macro in one Folio was seen in another")
+	}
+	if p, _ := builtinPackage("testbuiltin"); p.Macros[0].Block {
+		t.Errorf("a change to a built-in macro in a Folio changed the registered package")
+	}
+}
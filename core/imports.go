@@ -0,0 +1,254 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// importFiles opens the files named by an import command such as •&(fn). A
+// relative name is looked up beside the importing file first and then in
+// each of the Folio's IncludePaths. A name containing *, ?, or [ is a
+// pattern that imports every matching file, in sorted order, from the first
+// directory with a match. Each file must be inside the Folio's ImportRoot
+// when one is set, and it must not already be open further up the chain of
+// imports.
+func (s *scanner) importFiles(fn string) ([]*scanFile, error) {
+	if fn == "" {
+		return nil, fmt.Errorf("missing file name in import")
+	}
+
+	var f *Folio
+	if s.doc != nil {
+		f = s.doc.Folio
+	}
+
+	paths, err := findImports(fn, s.importDirs(f))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*scanFile, 0, len(paths))
+	for _, path := range paths {
+		if f != nil && f.ImportRoot != "" {
+			if err = checkImportRoot(path, f.ImportRoot); err != nil {
+				return nil, err
+			}
+		}
+
+		if chain := s.importChain(path); chain != nil {
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(chain, " -> "))
+		}
+
+		in, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file %q", path)
+		}
+
+		cobra.Tag("scan").Add("name", fn).Add("path", path).LogV("resolved import")
+
+		files = append(files, &scanFile{
+			doc:   s.doc,
+			name:  path,
+			path:  path,
+			input: string(in),
+			line:  1,
+		})
+	}
+
+	return files, nil
+}
+
+// importWanted returns true if the condition of a conditional import such as
+// •&[format=html](fn) holds. The condition format=NAME holds when the
+// document's format is NAME. Any other condition names a front matter field
+// or data key and holds when it is set to something other than false or the
+// empty string. Data set while rendering comes too late to affect imports. A
+// leading ! negates the condition.
+func (s *scanner) importWanted(cond string) (bool, error) {
+	negate := strings.HasPrefix(cond, "!")
+	if negate {
+		cond = strings.TrimSpace(cond[1:])
+	}
+
+	var want bool
+	switch {
+	case cond == "":
+		return false, fmt.Errorf("missing import condition")
+	case strings.HasPrefix(cond, "format="):
+		want = s.doc != nil && s.doc.Format == strings.TrimSpace(cond[len("format="):])
+	case s.doc != nil:
+		want = isSet(s.doc.Metadata[cond])
+		if !want && s.doc.Folio != nil {
+			val, found := s.doc.Folio.lookupData(cond)
+			want = found && isSet(val)
+		}
+	}
+
+	return want != negate, nil
+}
+
+// isSet returns false for nil, false, and empty values.
+func isSet(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false"
+	}
+	return true
+}
+
+// importDirs returns the directories searched for an imported file in the
+// order they are tried.
+func (s *scanner) importDirs(f *Folio) (dirs []string) {
+	// Generated text, such as a macro's output, has no path of its own, so
+	// its imports are relative to the document.
+	from := s.path
+	if from == "" && s.doc != nil {
+		from = s.doc.Path
+	}
+
+	if from != "" && from != "<stdin>" {
+		dirs = append(dirs, filepath.Dir(from))
+	}
+
+	if f != nil {
+		dirs = append(dirs, f.IncludePaths...)
+	}
+
+	return
+}
+
+// findImports returns the paths of the files named by fn in the first of dirs
+// that holds a match. An absolute fn is used as is.
+func findImports(fn string, dirs []string) ([]string, error) {
+	glob := strings.ContainsAny(fn, "*?[")
+
+	if filepath.IsAbs(fn) {
+		dirs = []string{""}
+	}
+
+	for _, dir := range dirs {
+		pattern := filepath.Join(dir, fn)
+
+		if !glob {
+			if info, err := os.Stat(pattern); err == nil && !info.IsDir() {
+				return []string{pattern}, nil
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad import pattern %q: %s", fn, err)
+		}
+
+		var paths []string
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() {
+				paths = append(paths, m)
+			}
+		}
+
+		if len(paths) > 0 {
+			sort.Strings(paths)
+			return paths, nil
+		}
+	}
+
+	where := ""
+	if !filepath.IsAbs(fn) {
+		where = " in " + strings.Join(dirs, ", ")
+	}
+
+	if glob {
+		return nil, fmt.Errorf("no files match imported pattern %q%s", fn, where)
+	}
+	return nil, fmt.Errorf("unable to find imported file %q%s", fn, where)
+}
+
+// checkImportRoot returns an error if path, after following symbolic links,
+// isn't inside root.
+func checkImportRoot(path, root string) error {
+	real := func(p string) (string, error) {
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+		if l, err := filepath.EvalSymlinks(p); err == nil {
+			p = l
+		}
+		return p, nil
+	}
+
+	rp, err := real(root)
+	if err != nil {
+		return fmt.Errorf("unable to locate the import root %q: %s", root, err)
+	}
+
+	pp, err := real(path)
+	if err != nil {
+		return fmt.Errorf("unable to locate imported file %q: %s", path, err)
+	}
+
+	rel, err := filepath.Rel(rp, pp)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("imported file %q is outside of the import root %q", path, root)
+	}
+
+	return nil
+}
+
+// importChain returns the files that lead from the document to path if path
+// is already being scanned. Otherwise it returns nil.
+func (s *scanner) importChain(path string) []string {
+	files := append(append([]*scanFile{}, s.fileStack...), s.scanFile)
+	target := absPath(path)
+
+	for i, sf := range files {
+		if sf.queued || sf.path == "" || absPath(sf.path) != target {
+			continue
+		}
+
+		chain := []string{}
+		for _, f := range files[i:] {
+			if !f.queued {
+				chain = append(chain, f.path)
+			}
+		}
+		return append(chain, path)
+	}
+
+	return nil
+}
+
+// absPath returns the absolute form of path, or path itself if it can't be
+// made absolute.
+func absPath(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
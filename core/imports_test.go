@@ -0,0 +1,192 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates the files, given as paths relative to a new temporary
+// directory mapped to their contents, and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "subtext")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func makeImport(f *Folio, path string) (string, error) {
+	d := NewDoc("testname", path)
+	if err := d.loadText(); err != nil {
+		return "", err
+	}
+	f.AppendDoc(d)
+	return f.MakeDocs()
+}
+
+func TestImportRelative(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.st":       ">>>\nmode: plain\n---\na •&(ch/one.st)d",
+		"ch/one.st":     "b •&(two.st)",
+		"ch/two.st":     "c •&(shared.st)",
+		"inc/shared.st": "!",
+	})
+	defer os.RemoveAll(dir)
+
+	f := NewFolio()
+	f.IncludePaths = append(f.IncludePaths, filepath.Join(dir, "inc"))
+
+	out, err := makeImport(f, filepath.Join(dir, "main.st"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "a b c !d"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+
+	d := f.Documents[0]
+	if len(d.Imports) != 3 || d.Imports[2] != filepath.Join(dir, "inc", "shared.st") {
+		t.Errorf("unexpected imports: %v", d.Imports)
+	}
+}
+
+func TestImportRoot(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"project/main.st": "a •&(../secret.st)",
+		"secret.st":       "b",
+	})
+	defer os.RemoveAll(dir)
+
+	f := NewFolio()
+	f.ImportRoot = filepath.Join(dir, "project")
+
+	_, err := makeImport(f, filepath.Join(dir, "project", "main.st"))
+	if err == nil || !strings.Contains(err.Error(), "outside of the import root") {
+		t.Errorf("expected an import root error, got %v", err)
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.st": "a •&(b.st)",
+		"b.st": "b •&(c.st)",
+		"c.st": "c •&(b.st)",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := makeImport(NewFolio(), filepath.Join(dir, "a.st"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	b, c := filepath.Join(dir, "b.st"), filepath.Join(dir, "c.st")
+	exp := "import cycle: " + b + " -> " + c + " -> " + b
+	if !strings.Contains(err.Error(), exp) {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, err.Error())
+	}
+}
+
+func TestImportDiagnostic(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.st": "a •&(b.st)",
+		"b.st": "one\ntwo •nosuch",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := makeImport(NewFolio(), filepath.Join(dir, "a.st"))
+	diag, ok := err.(*Diagnostic)
+	if !ok {
+		t.Fatalf("expected a *Diagnostic, got %T: %v", err, err)
+	}
+
+	if diag.File != filepath.Join(dir, "b.st") || diag.Line != 2 {
+		t.Errorf("expected %s:2, got %s:%d", filepath.Join(dir, "b.st"), diag.File, diag.Line)
+	}
+}
+
+func TestImportGlob(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"book.st":          ">>>\nmode: plain\n---\n•&(chapters/*.st)end",
+		"chapters/02.st":   "two •&(notes.st)",
+		"chapters/01.st":   "one ",
+		"chapters/10.st":   "ten ",
+		"chapters/notes.t": "x",
+		"notes.st":         "(notes) ",
+	})
+	defer os.RemoveAll(dir)
+
+	f := NewFolio()
+	f.IncludePaths = append(f.IncludePaths, dir)
+
+	out, err := makeImport(f, filepath.Join(dir, "book.st"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "one two (notes) ten end"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+
+	_, err = makeImport(NewFolio(), filepath.Join(dir, "chapters", "02.st"))
+	if err == nil || !strings.Contains(err.Error(), "unable to find imported file") {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestImportConditional(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.st": ">>>\nmode: plain\ndraft: true\nfinal: false\n---\n" +
+			"•&[format=html](html.st)•&[!format=html](other.st)" +
+			"•&[draft](draft.st)•&[final](final.st)•&[extra](extra.st).",
+		"html.st":  "html ",
+		"other.st": "other ",
+		"draft.st": "draft ",
+		"final.st": "final ",
+		"extra.st": "extra ",
+	})
+	defer os.RemoveAll(dir)
+
+	f := NewFolio()
+	f.SetData("extra", true)
+
+	out, err := makeImport(f, filepath.Join(dir, "main.st"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "other draft extra ."
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
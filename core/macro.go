@@ -23,11 +23,6 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-var Data map[string]interface{} = map[string]interface{}{}
-
-// Macros is the global repository for macro definitions.
-var Macros = MacroMap{}
-
 // Optional represents an optional parameter in a macro. If an argument is not
 // specified for the optional parameter, the parameter's default value is
 // used.
@@ -75,8 +70,15 @@ func NewMacroMap() MacroMap {
 		NewMacro("sys.import", "", nil, nil),
 		NewMacro("sys.setdata", "", []string{"data"}, nil),
 		NewMacro("sys.setdataf", "", []string{"data"}, nil),
-		NewMacro("sys.refdef", "", []string{"label", "ref"}, nil),
-		NewMacro("sys.ref", "", []string{"label"}, nil),
+		NewMacro("sys.refdef", "", []string{"label"}, []*Optional{NewOptional("ref", ""), NewOptional("counter", "")}),
+		NewMacro("sys.ref", "", []string{"label"}, []*Optional{NewOptional("as", "text")}),
+		NewMacro("sys.newcounter", "", []string{"name"}, []*Optional{NewOptional("parent", "")}),
+		NewMacro("sys.stepcounter", "", []string{"name"}, nil),
+		NewMacro("sys.resetcounter", "", []string{"name"}, []*Optional{NewOptional("value", "0")}),
+		NewMacro("sys.counter", "", []string{"name"}, nil),
+		NewMacro("sys.tocentry", "", []string{"level", "title"}, []*Optional{NewOptional("label", "")}),
+		NewMacro("sys.toc", "", nil, []*Optional{NewOptional("scope", "document"), NewOptional("depth", "0")}),
+		NewMacro("sys.notes", "", nil, []*Optional{NewOptional("kind", footnote)}),
 		// Regular macros
 		NewMacro("echo", "[[.text]]", []string{"text"}, nil),
 		NewBlockMacro("Echo", "[[.text]]", []string{"text"}, nil),
@@ -86,6 +88,13 @@ func NewMacroMap() MacroMap {
 		NewMacro("sq", "‘[[ .p ]]’", []string{"p"}, nil),
 		NewMacro("subtext", "subtext, version 0.0.1", nil, nil),
 		NewBlockMacro("Subtext", "subtext, version 0.0.1", nil, nil),
+		NewMacro("toc.list", "[[ .items ]]", []string{"level", "items"}, nil),
+		NewMacro("toc.item", "[[ .title ]]\n[[ .children ]]", []string{"level", "title", "label", "link", "children"}, nil),
+		NewNodeMacro("footnote", []string{"text"}, nil, noteMacro(footnote)),
+		NewNodeMacro("endnote", []string{"text"}, nil, noteMacro(endnote)),
+		NewMacro("note.marker", `[[ printf "[%s]" .number ]]`, []string{"kind", "number", "id", "text"}, nil),
+		NewMacro("note.list", "\n[[ .items ]]", []string{"kind", "items"}, nil),
+		NewMacro("note.item", "[[ .number ]]. [[ .text ]]\n", []string{"kind", "number", "id", "text"}, nil),
 	}
 
 	// Add default macros
@@ -143,6 +152,10 @@ type Macro struct {
 	Series             bool        // When true, subtext eats all space after the macro
 	Ld                 string      // Left delim used in the template
 	Rd                 string      // Right delim used in the template
+	Func               MacroFunc   // Go implementation, used instead of the template
+	NodeFunc           NodeFunc    // Go implementation returning nodes
+	Sigils             Sigils      // Sigils used in the template output and defaults
+	Pos                *Position   // Where the macro was defined, nil if it isn't from a source file
 }
 
 func NewBlockMacro(name, tmplt string, params []string, optionals []*Optional) *Macro {
@@ -158,6 +171,9 @@ func NewBlockMacro(name, tmplt string, params []string, optionals []*Optional) *
 		Rd:           "]]"}
 }
 
+// NewMacro creates a macro whose template is parsed with the shared template
+// functions. Templates that need a Folio's data functions, such as getdata,
+// must be parsed with Macro.Parse instead.
 func NewMacro(name, tmplt string, params []string, optionals []*Optional) *Macro {
 	t := template.Must(template.New(name).Funcs(funcMap).Delims("[[", "]]").Option("missingkey=error").Parse(tmplt))
 	return &Macro{
@@ -170,10 +186,13 @@ func NewMacro(name, tmplt string, params []string, optionals []*Optional) *Macro
 		Rd:           "]]"}
 }
 
-func (m *Macro) Parse() {
-	t := template.Must(template.New(m.Name).Funcs(funcMap).Delims(m.Ld, m.Rd).Option("missingkey=error").Parse(m.TemplateText))
+// Parse parses the macro's template and init template with the given
+// template functions. Use the Folio's functions so that templates can access
+// its data.
+func (m *Macro) Parse(funcs template.FuncMap) {
+	t := template.Must(template.New(m.Name).Funcs(funcs).Delims(m.Ld, m.Rd).Option("missingkey=error").Parse(m.TemplateText))
 	m.Template = t
-	i := template.Must(template.New(m.Name).Funcs(funcMap).Delims(m.Ld, m.Rd).Option("missingkey=error").Parse(m.Init))
+	i := template.Must(template.New(m.Name).Funcs(funcs).Delims(m.Ld, m.Rd).Option("missingkey=error").Parse(m.Init))
 	m.InitTemplate = i
 }
 
@@ -224,8 +243,8 @@ func (m *Macro) ValidateArgs(c *Cmd, d *Document) (NodeMap, error) {
 		if len(missing) > 1 {
 			s = "s"
 		}
-		return nil, fmt.Errorf("Line %d: command %q is missing %d argument%s: %v",
-			c.GetLineNum(), m.Name, len(missing), s, missing)
+		return nil, newDiagnostic(c.cmdToken, "command %q is missing %d argument%s: %v",
+			m.Name, len(missing), s, missing)
 	}
 	if unknown != nil {
 		// Unknown arguments are fatal.
@@ -233,17 +252,17 @@ func (m *Macro) ValidateArgs(c *Cmd, d *Document) (NodeMap, error) {
 		if len(unknown) > 1 {
 			s = "s"
 		}
-		return nil, fmt.Errorf("Line %d: command %q contains %d unknown argument%s: %v",
-			c.GetLineNum(), m.Name, len(unknown), s, unknown)
+		return nil, newDiagnostic(c.cmdToken, "command %q contains %d unknown argument%s: %v",
+			m.Name, len(unknown), s, unknown)
 	}
 	// The arguments are valid so add any missing optionals.
 	// parseOptions := &Options{Plain: true, Macros: Macros}
 	for _, o := range m.Optionals {
 		if _, found := selected[o.Name]; !found {
 			// nl, _, err := Parse(o.Name, o.Default, parseOptions)
-			nl, err := ParseMacro(o.Name, o.Default, d, 2)
+			nl, err := parseMacro(o.Name, o.Default, d, 2, m.Sigils)
 			if err != nil {
-				return nil, fmt.Errorf("parsing default: %s", err)
+				return nil, newDiagnostic(c.cmdToken, "parsing default for %q: %s", o.Name, diagnosticMessage(err))
 			}
 			selected[o.Name] = nl.NodeList
 		}
@@ -251,18 +270,18 @@ func (m *Macro) ValidateArgs(c *Cmd, d *Document) (NodeMap, error) {
 	return selected, nil
 }
 
-func (mm MacroMap) addNewMacro(cmd *Cmd, doc *Document, flowStyle bool) error {
+func (f *Folio) addNewMacro(cmd *Cmd, doc *Document, flowStyle bool) error {
 	name := "sys.newmacro"
 	// Retrieve the sys.newmacro system command
-	m, _ := mm.GetMacro(name, "")
+	m := f.GetSysMacro(name, "")
 	if m == nil {
-		return fmt.Errorf("Line %d: system command %q not defined.", cmd.GetLineNum(), name)
+		return newDiagnostic(cmd.cmdToken, "system command %q not defined", name)
 	}
 	cobra.Tag("cmd").Strunc("macro", m.TemplateText).LogfV("retrieved system command definition")
 
 	args, err := m.ValidateArgs(cmd, doc)
 	if err != nil {
-		return fmt.Errorf("Line %d: ValidateArgs failed on system command %q: %q", cmd.GetLineNum(), name, err)
+		return err
 	}
 	cobra.Tag("cmd").Strunc("syscmd", args["def"].String()).LogfV("system command: %s", args["def"])
 
@@ -275,7 +294,7 @@ func (mm MacroMap) addNewMacro(cmd *Cmd, doc *Document, flowStyle bool) error {
 	}
 
 	if err != nil {
-		return fmt.Errorf("Line %d: unmarshall error for system command %q: %q", cmd.GetLineNum(), name, err)
+		return newDiagnostic(cmd.cmdToken, "unmarshall error for system command %q: %s", name, err)
 	}
 	cobra.Tag("cmd").LogfV("marshalled syscmd: %+v", mdef)
 
@@ -305,13 +324,15 @@ func (mm MacroMap) addNewMacro(cmd *Cmd, doc *Document, flowStyle bool) error {
 		Series:       mdef.Series,
 		Ld:           left,
 		Rd:           right,
+		Sigils:       doc.Sigils,
+		Pos:          tokenPosition(cmd.cmdToken),
 	}
 
-	nm.Parse()
+	nm.Parse(f.funcs)
 	// mt := MacroType{m.Name, m.Format}
 	// p.macros[mt] = m // TODO: remove the parse.macro struct
 	// Macros[mt] = m
-	mm.AddMacro(nm)
+	f.AddMacro(nm)
 	cobra.Tag("cmd").LogfV("loaded new macro")
 	return nil
 }
@@ -51,11 +51,11 @@ func TestValidateArgs(t *testing.T) {
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"no arguments",
 		newPlainTestDoc("•testCmd[]"), 0,
-		"Line 1: command \"testMacro\" is missing 2 arguments: [aOne bTwo]", true))
+		"<stdin>:1:2: error: command \"testMacro\" is missing 2 arguments: [aOne bTwo]", true))
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"an anon argument with 1 missing",
 		newPlainTestDoc("•testCmd[{arg}]"), 0,
-		"Line 1: command \"testMacro\" is missing 1 argument: [bTwo]", true))
+		"<stdin>:1:2: error: command \"testMacro\" is missing 1 argument: [bTwo]", true))
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"right number of anon args",
 		newPlainTestDoc("•testCmd[{arg}{arg}]"), 0,
@@ -71,11 +71,11 @@ func TestValidateArgs(t *testing.T) {
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"one too many anonymous arguments",
 		newPlainTestDoc("•testCmd[{arg}{arg}{arg}{arg}]"), 0,
-		"Line 1: command \"testMacro\" contains 1 unknown argument: [#4]", true))
+		"<stdin>:1:2: error: command \"testMacro\" contains 1 unknown argument: [#4]", true))
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"two too many anonymous arguments",
 		newPlainTestDoc("•testCmd[{arg}{arg}{arg}{arg}{arg}]"), 0,
-		"Line 1: command \"testMacro\" contains 2 unknown arguments: [#4 #5]", true))
+		"<stdin>:1:2: error: command \"testMacro\" contains 2 unknown arguments: [#4 #5]", true))
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"right named args",
 		newPlainTestDoc("•testCmd[aOne={arg} bTwo={arg}]"), 0,
@@ -87,11 +87,11 @@ func TestValidateArgs(t *testing.T) {
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"named missing required argument",
 		newPlainTestDoc("•testCmd[aOne={arg}]"), 0,
-		"Line 1: command \"testMacro\" is missing 1 argument: [bTwo]", true))
+		"<stdin>:1:2: error: command \"testMacro\" is missing 1 argument: [bTwo]", true))
 	testValidateArgs(t, newArgsCheckTestCase(m,
 		"unknown argument",
 		newPlainTestDoc("•testCmd[aOne={arg} bTwo={arg} xxx={arg}]"), 0,
-		"Line 1: command \"testMacro\" contains 1 unknown argument: [xxx]", true))
+		"<stdin>:1:2: error: command \"testMacro\" contains 1 unknown argument: [xxx]", true))
 }
 
 type argsCheckTestCase struct {
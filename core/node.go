@@ -301,6 +301,7 @@ type Text struct {
 	NodeType
 	NodeValue
 	Peek
+	textToken *token // the token the text came from, nil if generated
 }
 
 func NewTextNode(t string) *Text {
@@ -605,6 +606,12 @@ func (m *Cmd) GetLineNum() int {
 	return m.cmdToken.lnum
 }
 
+// hasSourceToken returns true if the command was found in a source file
+// rather than in text generated by a macro.
+func (m *Cmd) hasSourceToken() bool {
+	return m != nil && m.cmdToken != nil && m.cmdToken.file != nil && m.cmdToken.file.path != ""
+}
+
 func (m *Cmd) GetCmdName() string {
 	return string(m.NodeValue)
 }
@@ -683,6 +690,7 @@ type ErrorNode struct {
 	NodeType
 	NodeValue
 	Peek
+	diag *Diagnostic // the reported problem, if any
 }
 
 func NewErrorNode(t string) *ErrorNode {
@@ -0,0 +1,160 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// The footnote and endnote macros queue their rendered text in the document
+// and leave a marker rendered by the note.marker macro. The queued notes are
+// placed at a flush point: the notes system command, the end of each
+// paragraph if the document's front matter sets "footnotes: paragraph", and
+// the end of the document. A flush point is rendered as a placeholder that is
+// replaced by the note.list and note.item macros once the Folio has been
+// rendered, so refs in the notes are resolved like any other.
+//
+// A format in which notes are placed by the typesetter, such as LaTeX, can
+// write the note's text in note.marker and leave note.list empty.
+const (
+	noteOpen  = "\uE004" // begins a note flush placeholder
+	noteClose = "\uE005" // ends a note flush placeholder
+)
+
+// The kinds of note. Each kind is numbered separately within a document.
+const (
+	footnote = "foot"
+	endnote  = "end"
+)
+
+// note is a footnote or endnote in a document.
+type note struct {
+	kind   string
+	number int
+	id     string // an anchor unique within the document, such as fn2
+	text   string // the rendered text of the note
+}
+
+// noteFlush is a list of notes waiting to be rendered.
+type noteFlush struct {
+	kind  string
+	notes []note
+	tok   *token   // the source token reported if the notes can't be rendered
+	stack []string // the macro call stack at the flush point
+}
+
+// noteMacro returns the Go macro that queues a note of the given kind.
+func noteMacro(kind string) NodeFunc {
+	return func(r *Render, args *MacroArgs) (NodeList, error) {
+		d := r.Doc
+		if d.noteCounts == nil {
+			d.noteCounts = make(map[string]int)
+		}
+		d.noteCounts[kind]++
+
+		n := note{kind: kind, number: d.noteCounts[kind], text: args.Get("text")}
+		n.id = kind[:1] + "n" + strconv.Itoa(n.number)
+		d.notes = append(d.notes, n)
+		cobra.Tag("note").WithField("kind", kind).Add("number", n.number).LogV("queued note")
+
+		marker := r.generatedCmd("note.marker", args.Cmd.cmdToken, map[string]string{
+			"kind":   kind,
+			"number": strconv.Itoa(n.number),
+			"id":     n.id,
+			"text":   n.text,
+		})
+		return NodeList{marker}, nil
+	}
+}
+
+// flushNotes places the queued notes of the given kind at a flush point.
+func (r *Render) flushNotes(n *Cmd, kind string) (items []RenderItem) {
+	f := noteFlush{kind: kind, tok: r.callerToken(n), stack: append([]string{}, r.context...)}
+
+	queued := r.Doc.notes[:0]
+	for _, nt := range r.Doc.notes {
+		if nt.kind == kind {
+			f.notes = append(f.notes, nt)
+		} else {
+			queued = append(queued, nt)
+		}
+	}
+	r.Doc.notes = queued
+
+	if len(f.notes) == 0 {
+		return
+	}
+
+	r.Doc.noteFlushes = append(r.Doc.noteFlushes, f)
+	ri := r.MakeRenderItem(refItem, noteOpen+strconv.Itoa(len(r.Doc.noteFlushes)-1)+noteClose)
+	ri.cmd = n
+	return append(items, ri)
+}
+
+// processNotesCmd handles the notes system command, which places the queued
+// notes of a kind, such as at the end of a section.
+func (r *Render) processNotesCmd(n *Cmd) []RenderItem {
+	name := n.GetCmdName()
+	m := r.getMacro(name, "")
+	if m == nil {
+		r.errorf(n, "system command %q not defined", name)
+	}
+
+	args, err := m.ValidateArgs(n, r.Doc)
+	if err != nil {
+		r.fail(n, err)
+	}
+
+	kind := strings.TrimSpace(args["kind"].String())
+	if kind != footnote && kind != endnote {
+		r.errorf(n, "notes kind %q isn't foot or end", kind)
+	}
+	return r.flushNotes(n, kind)
+}
+
+// expandNotes replaces the note flush placeholders in s with the notes
+// rendered by the note.list and note.item macros.
+func (d *Document) expandNotes(s string) (string, error) {
+	if len(d.noteFlushes) == 0 {
+		return s, nil
+	}
+
+	var err error
+	s = replacePlaceholders(s, noteOpen, noteClose, len(d.noteFlushes), func(n int) string {
+		f := &d.noteFlushes[n]
+		out, nerr := d.renderDeferred(f.tok, f.stack, func(r *Render, t *token) string {
+			items := strings.Builder{}
+			for _, nt := range f.notes {
+				items.WriteString(r.renderGenerated("note.item", t, map[string]string{
+					"kind":   nt.kind,
+					"number": strconv.Itoa(nt.number),
+					"id":     nt.id,
+					"text":   nt.text,
+				}))
+			}
+			return r.renderGenerated("note.list", t, map[string]string{
+				"kind":  f.kind,
+				"items": items.String(),
+			})
+		})
+		err = joinDiagnostics(err, nerr)
+		return out
+	})
+	cobra.Tag("render").WithField("flushes", len(d.noteFlushes)).LogV("expanded notes")
+	return s, err
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNotes(t *testing.T) {
+	tests := []struct {
+		text, exp string
+	}{
+		{
+			"a•footnote{one} b•endnote{two} c•footnote{three •echo{x}}",
+			"<a[1] b[1] c[2]>\n\n1. one\n2. three x\n\n1. two\n",
+		},
+		{
+			">>>\nfootnotes: paragraph\n---\na•footnote{one} b\n\nc•endnote{two}•footnote{three}\n\nd",
+			"<a[1] b>\n\n1. one\n<c[1][2]>\n\n2. three\n<d>\n\n1. two\n",
+		},
+		{
+			"a•endnote{see •(ref){x}}\n•(notes)[kind={end}]\nb•endnote{two}\n•(notes)[kind={foot}]\n•(refdef)[label={x} ref={X}]",
+			"<a[1]\n\n1. see X\n\nb[2]\n\n>\n\n2. two\n",
+		},
+	}
+
+	for _, tc := range tests {
+		f := NewFolio()
+		d := NewDoc("testname", "testpath")
+		d.Text = tc.text
+		f.AppendDoc(d)
+
+		out, err := f.MakeDocs()
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.text, err)
+		}
+		if out != tc.exp {
+			t.Errorf("%q\nExpected: %q\n     Got: %q", tc.text, tc.exp, out)
+		}
+	}
+}
+
+func TestNoteErrors(t *testing.T) {
+	f := NewFolio()
+	d := NewDoc("testname", "testpath")
+	d.Text = "a•footnote{one}\n•(notes)[kind={side}]"
+	f.AppendDoc(d)
+
+	exp := `notes kind "side" isn't foot or end`
+	if _, err := f.MakeDocs(); err == nil || !strings.Contains(err.Error(), exp) {
+		t.Errorf("Expected: %s\n     Got: %v", exp, err)
+	}
+
+	d = NewDoc("other", "otherpath")
+	d.Text = ">>>\nfootnotes: margin\n---\na"
+	exp = `footnotes must be paragraph or document, not "margin"`
+	if err := f.AppendDoc(d); err == nil || !strings.Contains(err.Error(), exp) {
+		t.Errorf("Expected: %s\n     Got: %v", exp, err)
+	}
+}
@@ -15,7 +15,6 @@
 package core
 
 import (
-	"fmt"
 	"strings"
 
 	"github.com/kevinkenan/cobra"
@@ -31,6 +30,7 @@ func Parse(d *Document) (*Section, error) {
 		root:    NewSection(),
 		empty:   true,
 		// reflow:  d.Reflow,
+		recovering: d.Folio != nil && d.Folio.KeepGoing,
 	}
 
 	if d.Plain {
@@ -86,13 +86,48 @@ func Parse(d *Document) (*Section, error) {
 // 	return doParse(d.Name, p)
 // }
 
+// ParseMacro creates a node tree from the output of a macro written with the
+// default sigils. Trees are cached by the document's Folio, so parsing the
+// same text again returns the same tree, which must not be modified.
 func ParseMacro(name, input string, doc *Document, depth int) (*Section, error) {
+	return parseMacro(name, input, doc, depth, DefaultSigils)
+}
+
+// parseMacro is ParseMacro for text written with the given sigils.
+func parseMacro(name, input string, doc *Document, depth int, sigils Sigils) (*Section, error) {
+	sigils = sigils.resolve()
+
+	var cache *parseCache
+	if doc.Folio != nil {
+		cache = doc.Folio.parses
+	}
+
+	k := parseKey{name, doc.Format, input, doc.Reflow, depth <= 1, sigils}
+	if root, found := cache.get(k); found {
+		cobra.Tag("parse").WithField("name", name).LogV("found cached parse")
+		return root, nil
+	}
+	gen := cache.generation()
+
+	p := newMacroParser(name, input, doc, depth, sigils)
+	root, err := doParse(name, p)
+
+	// Imports are recorded by the document, so parses that import files are
+	// repeated.
+	if err == nil && !p.scanner.imported {
+		cache.put(k, gen, root)
+	}
+
+	return root, err
+}
+
+func newMacroParser(name, input string, doc *Document, depth int, sigils Sigils) *parser {
 	// o.Name, o.Default, parseOptions
 	//opts := &Options{Plain: true, Macros: r.macros, Format: n.Format}
 	p := &parser{
 		doc:     doc,
 		macro:   true,
-		scanner: scanMacro(name, input, doc, depth),
+		scanner: scanMacro(name, input, doc, depth, sigils),
 		root:    NewSection(),
 		empty:   true,
 		// reflow:  doc.Reflow,
@@ -108,7 +143,7 @@ func ParseMacro(name, input string, doc *Document, depth int) (*Section, error)
 	// 	p.macros[MacroType{m.Name, m.Format}] = m
 	// }
 
-	return doParse(name, p)
+	return p
 }
 
 // TODO: remove this if unneeded
@@ -153,15 +188,17 @@ type parser struct {
 	// reflow             bool
 	stateStack         []*pstate
 	cmdDepth           int
-	insideSysCmd       bool // true when we're processing a syscmd
-	parMode            bool // true when the scanner is invoked with scan instead of scanPlain
-	diableParScanFlags bool // when true, the scanner ignores ¶ commands
-	parScanOn          bool // when true, the scanner generates paragraph commands
-	parScanFlag        bool // set by ¶ command
-	insidePar          bool // true if inside paragraph
-	horizMode          bool // true if cmd exists within a paragraph
-	blockMode          bool // true if we are currently in block mode
-	blockModeChange    bool // true when the block mode has changed
+	insideSysCmd       bool        // true when we're processing a syscmd
+	parMode            bool        // true when the scanner is invoked with scan instead of scanPlain
+	diableParScanFlags bool        // when true, the scanner ignores ¶ commands
+	parScanOn          bool        // when true, the scanner generates paragraph commands
+	parScanFlag        bool        // set by ¶ command
+	insidePar          bool        // true if inside paragraph
+	horizMode          bool        // true if cmd exists within a paragraph
+	blockMode          bool        // true if we are currently in block mode
+	blockModeChange    bool        // true when the block mode has changed
+	recovering         bool        // true if errors are collected instead of stopping the parse
+	diags              Diagnostics // errors collected while recovering
 }
 
 // GetMacro is a convenience function to get a macro.
@@ -220,6 +257,7 @@ func (p *parser) nextIf(ttype tokenType) (t *token) {
 	if t = p.next(); t.typeof == ttype {
 		return
 	}
+	p.scanError(t)
 	p.errorf("found %q instead of %q", tokenTypeLookup(t.typeof), tokenTypeLookup(ttype))
 	return
 }
@@ -294,6 +332,10 @@ func (p *parser) start() (n *Section, err error) {
 		}
 	}
 
+	if len(p.diags) > 0 {
+		return p.root, p.diags
+	}
+
 	// if p.doc.Template != "" && !p.macro {
 	// 	n := NewCmdNode(p.doc.Template+".end", &token{
 	// 		typeof: tokenCmdStart,
@@ -335,20 +377,17 @@ func (p *parser) parseBody() (nl NodeList, fileDone bool, err error) {
 		case tokenRightSquare:
 			cmdDone = p.parseRightSquare(t)
 		case tokenError:
-			p.errorf("Line %d: %s", t.lnum, t.value)
+			p.report(newDiagnostic(t, "%s", t.value), &nl)
 		case tokenEOF:
 			fileDone = p.parseEOF(t, &nl)
 		default:
-			p.errorf("Line %d: unexpected token %q in parseText", t.lnum, tokenTypeLookup(t.typeof))
+			p.errorAt(t, "unexpected token %q in parseText", tokenTypeLookup(t.typeof))
 		}
 
 		if cmdDone || fileDone {
 			return
 		}
 	}
-
-	cobra.Tag("parse").LogV("This should be impossible")
-	return
 }
 
 func (p *parser) parseComment() {
@@ -507,12 +546,16 @@ func (p *parser) makeTextNode(t *token) (*Text, int) {
 	}
 
 	n := NewTextNode(s)
+	n.textToken = t
 	return n, len(s)
 }
 
 func (p *parser) parseSysCmd(t *token, nl *NodeList) {
 	cobra.Tag("parse").Add("token", tokenTypeLookup(t.typeof)).LogV("begin")
 	var err error
+	if p.recovering {
+		defer p.recoverCmd(t, nl, *p, len(*nl))
+	}
 	p.insideSysCmd = true
 
 	_, cmd, err := p.makeCmd(t, nl)
@@ -522,9 +565,9 @@ func (p *parser) parseSysCmd(t *token, nl *NodeList) {
 
 	switch cmd.GetCmdName() {
 	case "sys.newmacrof":
-		err = p.doc.Folio.Macros.addNewMacro(cmd, p.doc, true)
+		err = p.doc.Folio.addNewMacro(cmd, p.doc, true)
 	case "sys.newmacro":
-		err = p.doc.Folio.Macros.addNewMacro(cmd, p.doc, false)
+		err = p.doc.Folio.addNewMacro(cmd, p.doc, false)
 	// case "sys.configf":
 	// 	err = p.processSysConfigCmd(cmd, true)
 	// case "sys.config":
@@ -535,7 +578,7 @@ func (p *parser) parseSysCmd(t *token, nl *NodeList) {
 	}
 
 	if err != nil {
-		p.errorf(err.Error())
+		p.fail(err, t)
 	}
 
 	p.insideSysCmd = false
@@ -544,9 +587,12 @@ func (p *parser) parseSysCmd(t *token, nl *NodeList) {
 }
 
 func (p *parser) parseCmd(t *token, nl *NodeList) (cmd *Cmd) {
+	if p.recovering {
+		defer p.recoverCmd(t, nl, *p, len(*nl))
+	}
 	par, cmd, err := p.makeCmd(t, nl)
 	if err != nil {
-		p.errorf(err.Error())
+		p.fail(err, t)
 	}
 
 	if par != nil {
@@ -620,7 +666,7 @@ func (p *parser) initCmd(c *Cmd) (par *Cmd) {
 
 	mac := p.GetMacro(name, format)
 	if mac == nil {
-		p.errorf("Line %d: command %q (format %q) not defined.", c.GetLineNum(), name, format)
+		p.errorAt(c.cmdToken, "command %q (format %q) not defined", name, format)
 		return
 	}
 
@@ -676,7 +722,7 @@ func (p *parser) parseSimpleCmd(m *Cmd) {
 	} else {
 		nl, _, err = p.parseBody()
 		if err != nil {
-			panic(fmt.Errorf(err.Error()))
+			panic(err)
 		}
 	}
 
@@ -697,6 +743,8 @@ func (p *parser) assembleText() NodeList {
 		case tokenRightCurly:
 			p.backup()
 			return NodeList{NewTextNode(w.String())}
+		case tokenError:
+			p.scanError(t)
 		default:
 			w.WriteString(t.value)
 		}
@@ -764,7 +812,7 @@ func (p *parser) parseNamedArgs(m *Cmd) {
 		} else {
 			nl, _, err = p.parseBody()
 			if err != nil {
-				panic(fmt.Errorf(err.Error()))
+				panic(err)
 			}
 		}
 
@@ -778,8 +826,6 @@ func (p *parser) parseNamedArgs(m *Cmd) {
 			return
 		}
 	}
-
-	return
 }
 
 func (p *parser) parsePostionalArgs(m *Cmd) {
@@ -794,7 +840,7 @@ func (p *parser) parsePostionalArgs(m *Cmd) {
 		} else {
 			nl, _, err = p.parseBody()
 			if err != nil {
-				panic(fmt.Errorf(err.Error()))
+				panic(err)
 			}
 		}
 
@@ -808,7 +854,6 @@ func (p *parser) parsePostionalArgs(m *Cmd) {
 			return
 		}
 	}
-	return
 }
 
 func (p *parser) parseCmdFlags(m *Cmd) {
@@ -826,10 +871,10 @@ func (p *parser) parseCmdFlags(m *Cmd) {
 		case tokenRightAngle:
 			return
 		default:
-			p.errorf("unexpected %q in command flags on line %d", t.value, t.lnum)
+			p.scanError(t)
+			p.errorAt(t, "unexpected %q in command flags", t.value)
 		}
 	}
-	return
 }
 
 func (p *parser) parseRightCurly(t *token) (cmdDone bool) {
@@ -908,15 +953,119 @@ func (p *parser) parseEOF(t *token, nl *NodeList) bool {
 // 	return nil
 // }
 
+// errorf stops the parse with a Diagnostic located at the current token.
 func (p *parser) errorf(format string, args ...interface{}) {
-	p.root = nil
-	// format = fmt.Sprintf("template: %s:%d: %s", t.ParseName, t.token[0].line, format)
-	panic(Error(fmt.Sprintf(format, args...)))
+	p.errorAt(p.buffer, format, args...)
+}
+
+// errorAt stops the parse with a Diagnostic located at the token.
+func (p *parser) errorAt(t *token, format string, args ...interface{}) {
+	panic(newDiagnostic(t, format, args...))
+}
+
+// scanError stops the parse with the scanner's message if t reports an error
+// found by the scanner.
+func (p *parser) scanError(t *token) {
+	if t.typeof == tokenError {
+		p.errorAt(t, "%s", t.value)
+	}
+}
+
+// fail stops the parse with err, locating it at the token unless it is
+// already a Diagnostic.
+func (p *parser) fail(err error, t *token) {
+	panic(asDiagnostic(err, t))
+}
+
+// report records d and adds an ErrorNode in its place when recovering.
+// Otherwise it stops the parse.
+func (p *parser) report(d *Diagnostic, nl *NodeList) {
+	if !p.recovering {
+		panic(d)
+	}
+
+	cobra.Tag("parse").WithField("error", d.Error()).LogV("recording error")
+	p.diags = append(p.diags, d)
+	en := NewErrorNode(d.Message)
+	en.diag = d
+	*nl = appendNode(*nl, en)
+	p.link(en)
+}
+
+// recoverCmd handles an error raised while parsing the command that starts
+// at t. The parser's state is restored to what it was before the command,
+// the nodes added to nl since then are replaced by an ErrorNode, and the
+// rest of the command is skipped so the parse can continue.
+func (p *parser) recoverCmd(t *token, nl *NodeList, saved parser, n int) {
+	e := recover()
+	if e == nil {
+		return
+	}
+
+	var d *Diagnostic
+	switch e.(type) {
+	case *Diagnostic:
+		d = e.(*Diagnostic)
+	case Error:
+		d = newDiagnostic(t, "%s", e)
+	default:
+		panic(e)
+	}
+
+	diags, buffer, empty := p.diags, p.buffer, p.empty
+	*p = saved
+	p.diags, p.buffer, p.empty = diags, buffer, empty
+
+	*nl = (*nl)[:n]
+	p.report(d, nl)
+	p.skipCmd(t)
+}
+
+// skipCmd discards the unparsed tokens of the command that starts at t. The
+// command ends with the } or ] that returns the scanner to the depth of t.
+// At the top level a blank line also ends the command since the closing
+// brace or bracket that may follow is ignored there.
+func (p *parser) skipCmd(t *token) {
+	entered := false
+	for {
+		nt := p.peek()
+		switch {
+		case nt.typeof == tokenEOF:
+			return
+		case nt.depth > t.depth:
+			if nt.typeof == tokenEmptyLine && p.cmdDepth == 0 {
+				return
+			}
+			entered = true
+		case entered, !isCmdSyntax(nt.typeof):
+			return
+		}
+		cobra.Tag("parse").Add("token", tokenTypeLookup(nt.typeof)).LogV("skipping")
+		p.next()
+	}
+}
+
+// isCmdSyntax returns true if the token is part of a command other than
+// its text blocks.
+func isCmdSyntax(t tokenType) bool {
+	switch t {
+	case tokenName, tokenRunes, tokenLeftAngle, tokenRightAngle, tokenComma,
+		tokenEqual, tokenLeftCurly, tokenLeftSquare, tokenError:
+		return true
+	}
+	return false
 }
 
 func (p *parser) recover(errk *error) {
 	if e := recover(); e != nil {
-		*errk = e.(Error)
+		switch e.(type) {
+		case *Diagnostic:
+			*errk = e.(*Diagnostic)
+		case Error:
+			*errk = e.(Error)
+		default:
+			panic(e)
+		}
 	}
 }
 
@@ -0,0 +1,110 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"sync"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// maxParseCacheSize limits the number of node trees kept by a parseCache.
+const maxParseCacheSize = 4096
+
+// parseKey identifies the text parsed by ParseMacro along with the settings
+// that change the resulting node tree.
+type parseKey struct {
+	name     string // the macro or parameter name
+	format   string // the document's output format
+	input    string // the text being parsed
+	reflow   bool   // true if the document reflows paragraphs
+	literals bool   // true if literals are converted to text
+	sigils   Sigils // the sigils the text is written with
+}
+
+// parseCache holds the node trees produced by ParseMacro so that repeated
+// expansions of a macro, its default arguments, and page templates are only
+// parsed once. Rendering does not modify nodes, so a tree may be shared by
+// documents rendered at the same time.
+//
+// The nodes record which macros were defined when they were parsed, so the
+// cache is emptied whenever the Folio's macros change.
+type parseCache struct {
+	mu      sync.Mutex
+	gen     uint64 // incremented each time the cache is invalidated
+	entries map[parseKey]*Section
+}
+
+func newParseCache() *parseCache {
+	return &parseCache{entries: make(map[parseKey]*Section)}
+}
+
+// get returns the cached tree for k. A nil cache never finds anything.
+func (c *parseCache) get(k parseKey) (s *Section, found bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, found = c.entries[k]
+	return
+}
+
+// generation returns a value that put uses to discard trees parsed before
+// the cache was last invalidated.
+func (c *parseCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put adds the tree for k unless the cache was invalidated since gen was
+// retrieved. The cache is emptied when it is full.
+func (c *parseCache) put(k parseKey, gen uint64, s *Section) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if len(c.entries) >= maxParseCacheSize {
+		cobra.Tag("parse").LogV("parse cache is full")
+		c.entries = make(map[parseKey]*Section)
+	}
+
+	c.entries[k] = s
+}
+
+// invalidate empties the cache.
+func (c *parseCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[parseKey]*Section)
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestParseCache(t *testing.T) {
+	f := NewFolio()
+	d := NewDoc("testname", "test.st")
+	f.AppendDoc(d)
+
+	s1, err := ParseMacro("echo", "a •echo{b}", d, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s2, _ := ParseMacro("echo", "a •echo{b}", d, 1)
+	if s1 != s2 {
+		t.Errorf("expected the cached tree")
+	}
+
+	s3, _ := ParseMacro("echo", "a •echo{b}", d, 2)
+	if s1 == s3 {
+		t.Errorf("expected a new tree when literals are not scanned")
+	}
+
+	d.Format = "html"
+	if s4, _ := ParseMacro("echo", "a •echo{b}", d, 1); s1 == s4 {
+		t.Errorf("expected a new tree for a different format")
+	}
+	d.Format = ""
+
+	f.AddMacro(NewMacro("other", "", nil, nil))
+	if s5, _ := ParseMacro("echo", "a •echo{b}", d, 1); s1 == s5 {
+		t.Errorf("expected a new tree after the macros changed")
+	}
+}
+
+func TestParseCacheErrors(t *testing.T) {
+	f := NewFolio()
+	d := NewDoc("testname", "test.st")
+	f.AppendDoc(d)
+
+	if _, err := ParseMacro("x", "•later", d, 1); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	f.AddMacro(NewMacro("later", "", nil, nil))
+	if _, err := ParseMacro("x", "•later", d, 1); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// A ref is rendered as a placeholder holding its index in the document's list
+// of pending refs. The placeholder is plain text to the parser and to
+// templates, so it survives being passed through macro arguments. Once every
+// document in the Folio has been rendered, the placeholders are replaced with
+// the refs' values. A ref can therefore name a label defined later in the
+// document or in another document of the Folio.
+//
+// Since a template sees only the placeholder, a macro can place a ref in its
+// output but can't look at the ref's value. Template functions such as upper
+// or len would work on the placeholder's text, so they report an error when
+// given a ref instead.
+const (
+	refOpen  = "\uE000" // begins a ref placeholder (a private use character)
+	refClose = "\uE001" // ends a ref placeholder
+)
+
+// pendingRef is a ref waiting to be resolved.
+type pendingRef struct {
+	label string
+	path  bool     // true if the ref is replaced by a link to the label
+	tok   *token   // the source token reported if the label isn't defined
+	stack []string // the macro call stack where the ref was written
+}
+
+// refDef records where a label is defined.
+type refDef struct {
+	doc *Document
+	tok *token // the refdef, or nil if it isn't in a source file
+}
+
+// refDup identifies a refdef that repeats a label defined elsewhere.
+type refDup struct {
+	label string
+	doc   *Document
+	pos   Position
+}
+
+// deferRef records a ref to label and returns its placeholder. If path is
+// true, the placeholder is replaced by a link to the label instead of its
+// text.
+func (r *Render) deferRef(n *Cmd, label string, path bool) string {
+	r.Doc.refs = append(r.Doc.refs, pendingRef{
+		label: label,
+		path:  path,
+		tok:   r.callerToken(n),
+		stack: append([]string{}, r.context...),
+	})
+	return refOpen + strconv.Itoa(len(r.Doc.refs)-1) + refClose
+}
+
+// FirstPass looks through the source of every document in the Folio before
+// any of them is rendered. It finds the refdef commands so that the document
+// defining each label is known, and it reports labels defined more than
+// once. Refdefs in imported files or in the output of macros are found when
+// the document is rendered. It also notes whether any document has a table
+// of contents for the whole Folio and which documents define macros or data.
+func (f *Folio) FirstPass() error {
+	var diags Diagnostics
+
+	f.mu.Lock()
+	f.folioTOC = false
+	f.mu.Unlock()
+
+	for _, d := range f.GetDocs() {
+		d.definitions = false
+		root, err := ParseSyntax(d)
+		if err != nil {
+			// The problem is reported when the document is rendered.
+			cobra.Tag("render").WithField("doc", d.Name).LogV("unable to read the document in the first pass")
+			continue
+		}
+
+		walkSysCmds(root, 0, func(name string, n *SyntaxNode, offset int) {
+			switch name {
+			case "newmacro", "newmacrof", "setdata", "setdataf":
+				d.definitions = true
+			case "refdef":
+				label, ok := plainText(syntaxArg(n, "label", 0))
+				if !ok {
+					// The label isn't known until the document is rendered.
+					return
+				}
+				// The renderer locates a system command just after its (.
+				t := &token{
+					loc:  Loc(offset + len(n.Children[0].Text)),
+					file: &scanFile{path: d.Path, input: d.Text},
+				}
+				if err := f.defineRef(label, d, t); err != nil {
+					diags = append(diags, err.(*Diagnostic))
+				}
+			case "toc":
+				if scope, _ := plainText(syntaxArg(n, "scope", 0)); strings.TrimSpace(scope) == "folio" {
+					f.mu.Lock()
+					f.folioTOC = true
+					f.mu.Unlock()
+				}
+			}
+		})
+		if len(diags) > 0 && !f.KeepGoing {
+			return diags[0]
+		}
+	}
+
+	if len(diags) > 0 {
+		return diags
+	}
+	return nil
+}
+
+// walkSysCmds calls fn with the name of each system command below n, the
+// command's node, and its offset in the text. The tree n begins at offset.
+func walkSysCmds(n *SyntaxNode, offset int, fn func(name string, cmd *SyntaxNode, offset int)) {
+	if n.isSysCmd() && len(n.Children) > 1 {
+		fn(n.Children[1].Text, n, offset)
+	}
+
+	for _, c := range n.Children {
+		walkSysCmds(c, offset, fn)
+		offset += len(c.String())
+	}
+}
+
+// syntaxArg returns the block of the command's argument with the given name,
+// or of its argument at the position if the arguments aren't named.
+func syntaxArg(cmd *SyntaxNode, name string, position int) *SyntaxNode {
+	var pos int
+	for _, c := range cmd.Children {
+		for _, a := range syntaxArgs(c) {
+			switch {
+			case a.name == name:
+				return a.block
+			case a.name == "" && pos == position:
+				return a.block
+			case a.name == "":
+				pos++
+			}
+		}
+	}
+	return nil
+}
+
+// syntaxArgument is an argument of a command in a syntax tree.
+type syntaxArgument struct {
+	name  string
+	block *SyntaxNode
+}
+
+// syntaxArgs returns the arguments held by n, a child of a command node.
+func syntaxArgs(n *SyntaxNode) (args []syntaxArgument) {
+	switch n.Kind {
+	case SyntaxBlock:
+		args = append(args, syntaxArgument{block: n})
+	case SyntaxContext:
+		for _, a := range n.Children {
+			if a.Kind != SyntaxArg {
+				continue
+			}
+			arg := syntaxArgument{}
+			for _, c := range a.Children {
+				switch {
+				case c.is(tokenName):
+					arg.name = c.Text
+				case c.Kind == SyntaxBlock:
+					arg.block = c
+				}
+			}
+			args = append(args, arg)
+		}
+	}
+	return
+}
+
+// plainText returns the text inside a block that holds nothing but text.
+func plainText(block *SyntaxNode) (string, bool) {
+	if block == nil {
+		return "", false
+	}
+
+	b := strings.Builder{}
+	for _, c := range block.Children {
+		switch {
+		case c.is(tokenLeftCurly), c.is(tokenRightCurly):
+		case c.is(tokenText):
+			b.WriteString(c.Text)
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+// defineRef records that d defines label at the token. It is an error for
+// the label to be defined anywhere else.
+func (f *Folio) defineRef(label string, d *Document, t *token) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	def, found := f.refDefs[label]
+	if !found {
+		f.refDefs[label] = refDef{doc: d, tok: t}
+		return nil
+	}
+
+	at, prev := tokenPosition(t), tokenPosition(def.tok)
+	if def.doc == d && (at == nil || prev == nil || *at == *prev) {
+		// The same refdef seen by the first pass and again while rendering,
+		// or one made by a macro.
+		return nil
+	}
+
+	// The first pass and the render find the same duplicates, so each is
+	// only reported once.
+	dup := refDup{label: label, doc: d}
+	if at != nil {
+		dup.pos = *at
+	}
+	if f.refDups[dup] {
+		return nil
+	}
+	f.refDups[dup] = true
+
+	diag := newDiagnostic(t, "ref %q is already defined", label)
+	switch {
+	case prev != nil:
+		diag.Message += " at " + prev.String()
+	case def.doc != d:
+		diag.Message += " in " + def.doc.Path
+	}
+	return diag
+}
+
+// forgetRefs removes the labels defined by d along with their values, so that
+// a document replacing d may define them again and documents rendered later
+// can't refer to them.
+func (f *Folio) forgetRefs(d *Document) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for label, def := range f.refDefs {
+		if def.doc == d {
+			delete(f.refDefs, label)
+			delete(f.Data, "ref."+label)
+		}
+	}
+	for dup := range f.refDups {
+		if dup.doc == d {
+			delete(f.refDups, dup)
+		}
+	}
+}
+
+// refDef returns where label is defined.
+func (f *Folio) refDef(label string) (def refDef, found bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	def, found = f.refDefs[label]
+	return
+}
+
+// linkTo returns a link from the document to the label in other, or to the
+// top of other if the label is empty. Labels in another output file are
+// linked by the path relative to this document's output.
+func (d *Document) linkTo(other *Document, label string) string {
+	anchor := "#" + label
+	if other == d || other.OutputPath == "" || d.OutputPath == "" || other.OutputPath == d.OutputPath {
+		return anchor
+	}
+
+	if label == "" {
+		anchor = ""
+	}
+	rel, err := filepath.Rel(filepath.Dir(d.OutputPath), other.OutputPath)
+	if err != nil {
+		return filepath.ToSlash(other.OutputPath) + anchor
+	}
+	return filepath.ToSlash(rel) + anchor
+}
+
+// resolveRefs replaces the ref placeholders in s with the values defined by
+// refdef. Placeholders whose labels aren't defined are removed and reported
+// in a single Diagnostic that lists every missing label.
+func (d *Document) resolveRefs(s string) (string, error) {
+	if len(d.refs) == 0 {
+		return s, nil
+	}
+
+	var first *pendingRef
+	var missing []string
+	seen := map[string]bool{}
+
+	s = replacePlaceholders(s, refOpen, refClose, len(d.refs), func(n int) string {
+		ref := &d.refs[n]
+		if val, found := d.refValue(ref); found {
+			return val
+		}
+
+		if first == nil {
+			first = ref
+		}
+		if !seen[ref.label] {
+			seen[ref.label] = true
+			missing = append(missing, strconv.Quote(ref.label))
+		}
+		return ""
+	})
+	cobra.Tag("render").WithField("refs", len(d.refs)).Add("missing", len(missing)).LogV("resolved refs")
+
+	if first == nil {
+		return s, nil
+	}
+
+	var diag *Diagnostic
+	if len(missing) == 1 {
+		diag = newDiagnostic(first.tok, "ref %s was not found", missing[0])
+	} else {
+		diag = newDiagnostic(first.tok, "%d refs were not found: %s", len(missing), strings.Join(missing, ", "))
+	}
+	if len(first.stack) > 0 {
+		diag.Stack = first.stack
+	}
+	return s, diag
+}
+
+// refValue returns the text that replaces the ref in the document's output.
+// The ref may have been written in another document, such as in a heading
+// shown in this document's table of contents.
+func (d *Document) refValue(ref *pendingRef) (string, bool) {
+	def, defined := d.Folio.refDef(ref.label)
+	val, found := d.Folio.lookupData("ref." + ref.label)
+	switch {
+	case ref.path && defined:
+		d.addRefSource(def.doc)
+		return d.linkTo(def.doc, ref.label), true
+	case !ref.path && found:
+		if defined {
+			d.addRefSource(def.doc)
+		}
+		return fmt.Sprint(val), true
+	}
+	return "", false
+}
+
+// addRefSource adds the path of the other document to the document's Refs.
+func (d *Document) addRefSource(other *Document) {
+	if other == d {
+		return
+	}
+	for _, p := range d.Refs {
+		if p == other.Path {
+			return
+		}
+	}
+	d.Refs = append(d.Refs, other.Path)
+}
+
+// HasFolioTOC returns true if the first pass found a table of contents for
+// the whole Folio. Every document must then be rendered to collect its
+// headings.
+func (f *Folio) HasFolioTOC() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.folioTOC
+}
+
+// DefinesMacros returns true if the first pass found a macro or data
+// definition in the document's text. Definitions made by imported files
+// aren't found until the document is rendered.
+func (d *Document) DefinesMacros() bool {
+	return d.definitions
+}
+
+// DefinesRefs returns true if the document defines a ref label.
+func (d *Document) DefinesRefs() bool {
+	f := d.Folio
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, def := range f.refDefs {
+		if def.doc == d {
+			return true
+		}
+	}
+	return false
+}
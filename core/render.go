@@ -37,13 +37,15 @@ func (r RenderError) Error() string {
 // needed during the rendering.
 type Render struct {
 	Doc           *Document
-	InParagraph   bool     // true indicates that execution is in a paragraph.
-	ParBuffer     *Cmd     //
-	depth         int      // tracks recursion depth
-	context       []string // macro/arg call stack
-	skipNodeCount int      // skip the next nodes
-	init          bool     // true if in init mode (no output is written)
-	ref           bool     // true if references should be rendered
+	InParagraph   bool        // true indicates that execution is in a paragraph.
+	ParBuffer     *Cmd        //
+	depth         int         // tracks recursion depth
+	context       []string    // macro/arg call stack
+	calls         []*Cmd      // commands being rendered, outermost first
+	skipNodeCount int         // skip the next nodes
+	init          bool        // true if in init mode (no output is written)
+	ref           bool        // true if references should be rendered
+	diags         Diagnostics // errors collected when the Folio keeps going
 }
 
 func NewRender(d *Document) *Render {
@@ -64,6 +66,7 @@ type RenderItem struct {
 	kind     itemKind
 	text     string
 	line     int
+	cmd      *Cmd // the command that created the item
 }
 
 func (r *RenderItem) String() string {
@@ -71,11 +74,8 @@ func (r *RenderItem) String() string {
 	case textItem:
 		return r.text
 	case refItem:
-		if ref, found := r.renderer.Doc.Folio.Data[r.text]; !found {
-			panic(RenderError{message: fmt.Sprintf("line %d: ref '%s' was not found", r.line, r.text)})
-		} else {
-			return string(ref.(string))
-		}
+		// The placeholder is replaced after the Folio is rendered.
+		return r.text
 	default:
 		panic(RenderError{message: fmt.Sprintf("line %d: unknown RenderItem '%s'", r.line, r.text)})
 	}
@@ -107,11 +107,25 @@ func (r *Render) addMacros(mm MacroMap) {
 func (r *Render) ConvertRenderItems(ris []RenderItem) string {
 	outb := strings.Builder{}
 	for _, i := range ris {
-		outb.WriteString(i.String())
+		outb.WriteString(r.itemString(i))
 	}
 	return outb.String()
 }
 
+// itemString returns the text of the item. When the Folio keeps going after
+// errors, an item that can't be resolved is recorded and renders as nothing.
+func (r *Render) itemString(i RenderItem) (s string) {
+	if r.keepGoing() {
+		defer func() {
+			if e := recover(); e != nil {
+				r.collect(i.cmd, e)
+				s = ""
+			}
+		}()
+	}
+	return i.String()
+}
+
 func (r *Render) renderToString(root *Section) string {
 	ris := r.render(root)
 	return r.ConvertRenderItems(ris)
@@ -167,7 +181,7 @@ func (r *Render) renderNode(n Node) (items []RenderItem) {
 
 	r.depth += 1
 	if r.depth > 50 {
-		panic(RenderError{message: "exceeded call depth"})
+		r.errorf(nil, "exceeded call depth")
 	}
 
 	// s := new(strings.Builder)
@@ -191,13 +205,7 @@ func (r *Render) renderNode(n Node) (items []RenderItem) {
 		c := n.(*Cmd)
 		cobra.Tag("render").WithField("argcount", len(c.ArgList)+len(c.ArgMap)).Add("name", c.NodeValue).LogV("rendering cmd node")
 
-		if c.SysCmd {
-			items = append(items, r.processSysCmd(c)...)
-			// s.WriteString(r.processSysCmd(c))
-		} else {
-			items = append(items, r.processCmd(c)...)
-			// s.WriteString(r.processCmd(c))
-		}
+		items = append(items, r.renderCmd(c)...)
 	case *ErrorNode:
 		cobra.Tag("render").LogV("rendering error node")
 		items = append(items, r.MakeRenderItem(textItem, n.(*ErrorNode).GetErrorMsg()))
@@ -236,10 +244,19 @@ func (r *Render) processSysCmd(n *Cmd) (items []RenderItem) {
 	case "sys.refdef":
 		r.setRef(n, false)
 	case "sys.ref":
-		items = append(items, r.MakeRenderItem(refItem, r.getRef(n, false)))
+		label, path := r.getRef(n)
+		ri := r.MakeRenderItem(refItem, r.deferRef(n, label, path))
+		ri.cmd = n
+		items = append(items, ri)
+	case "sys.newcounter", "sys.stepcounter", "sys.resetcounter", "sys.counter":
+		items = append(items, r.processCounterCmd(n)...)
+	case "sys.tocentry", "sys.toc":
+		items = append(items, r.processTOCCmd(n)...)
+	case "sys.notes":
+		items = append(items, r.processNotesCmd(n)...)
 	case "sys.import":
 	default:
-		panic(RenderError{message: fmt.Sprintf("Line %d: unknown system command: %q", n.GetLineNum(), name)})
+		r.errorf(n, "unknown system command: %q", name)
 	}
 
 	return
@@ -250,29 +267,30 @@ func (r *Render) processCmd(n *Cmd) (items []RenderItem) {
 	items = []RenderItem{}
 	name := n.GetCmdName()
 	r.pushContext(name)
+	r.pushCall(n)
 	cobra.Tag("render").WithField("cmd", name).LogV("rendering command (cmd)")
 	cmdLog := cobra.Tag("cmd")
 
 	// Get the macro definition.
 	m := r.getMacro(name, n.Format)
 	if m == nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: macro %q (format %q) not defined.", n.GetLineNum(), name, n.Format)})
+		r.errorf(n, "macro %q (format %q) not defined", name, n.Format)
 	}
 	cmdLog.Copy().Strunc("macro", m.TemplateText).LogfV("retrieved macro definition")
 
 	if m.InitTemplate != nil {
 		data := map[string]interface{}{}
-		data["Data"] = r.Doc.Folio.Data
+		data["Data"] = r.Doc.Folio.copyData()
 		_, err := r.ExecuteMacro(m, data, true)
 		if err != nil {
-			panic(RenderError{fmt.Sprintf("error executing init template %q: %s", name, err)})
+			r.failf(n, err, "error executing init template %q", name)
 		}
 		cmdLog.Copy().Add("name", name).Add("ld", m.Ld).Logf("executed init macro")
 	}
 
 	args, err := m.ValidateArgs(n, r.Doc)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: ValidateArgs failed on macro %q: %s", n.GetLineNum(), name, err)})
+		r.fail(n, err)
 	}
 
 	renArgs := newCmdArgs(r.Doc)
@@ -286,25 +304,39 @@ func (r *Render) processCmd(n *Cmd) (items []RenderItem) {
 		r.popContext()
 	}
 
-	// Apply the command's arguments to the macro.
-	s, err := r.ExecuteMacro(m, renArgs, false)
-	if err != nil {
-		panic(RenderError{fmt.Sprintf("error rendering macro %q: %s", name, err)})
-	}
-	cmdLog.Copy().Add("name", name).Add("ld", m.Ld).Logf("executed macro, ready for parsing")
-
 	// Handle commands embedded in the macro.
 	var output *Section
-	// plain := false
 
-	// if strings.HasPrefix(name, "paragraph") {
-	// 	plain = true
-	// }
+	if m.isGoMacro() {
+		margs := &MacroArgs{Cmd: n, Nodes: args, Text: make(map[string]string)}
+		for k := range args {
+			margs.Text[k] = renArgs[k].(string)
+		}
 
-	// output, err = ParseText(s, plain, r.Doc)
-	output, err = ParseMacro(name, s, r.Doc, r.depth)
-	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: error in template for macro %q: %q", n.GetLineNum(), name, err)})
+		output, err = r.executeGoMacro(m, margs)
+		if err != nil {
+			r.failf(n, err, "error rendering macro %q", name)
+		}
+		cmdLog.Copy().Add("name", name).Logf("executed go macro")
+	} else {
+		// Apply the command's arguments to the macro.
+		s, err := r.ExecuteMacro(m, renArgs, false)
+		if err != nil {
+			r.failf(n, err, "error rendering macro %q", name)
+		}
+		cmdLog.Copy().Add("name", name).Add("ld", m.Ld).Logf("executed macro, ready for parsing")
+
+		// plain := false
+
+		// if strings.HasPrefix(name, "paragraph") {
+		// 	plain = true
+		// }
+
+		// output, err = ParseText(s, plain, r.Doc)
+		output, err = parseMacro(name, s, r.Doc, r.depth, m.Sigils)
+		if err != nil {
+			r.failf(n, err, "in output of macro %q", name)
+		}
 	}
 	cmdLog.Copy().Add("nodes", output.Count()-1).LogfV("parsed macro, ready for rendering")
 
@@ -316,6 +348,7 @@ func (r *Render) processCmd(n *Cmd) (items []RenderItem) {
 		// outs = outs + "\n"
 	}
 
+	r.popCall()
 	r.popContext()
 
 	return
@@ -331,13 +364,13 @@ func (r *Render) exec(n *Cmd) (items []RenderItem) {
 	// Get the macro definition.
 	m := r.getMacro(name, "")
 	if m == nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: macro %q not defined in exec.", n.GetLineNum(), name)})
+		r.errorf(n, "macro %q not defined in exec", name)
 	}
 	cmdLog.Copy().Strunc("macro", m.TemplateText).LogfV("retrieved macro definition")
 
 	args, err := m.ValidateArgs(n, r.Doc)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: ValidateArgs failed on macro %q: %q", n.GetLineNum(), name, err)})
+		r.fail(n, err)
 	}
 
 	// renArgs := map[string]interface{}{}
@@ -348,32 +381,40 @@ func (r *Render) exec(n *Cmd) (items []RenderItem) {
 		cmdLog.Copy().Strunc("arg", k).Strunc("val", v).LogV("prepared command argument")
 	}
 
-	m = NewBlockMacro("exec", renArgs["template"].(string), nil, nil)
+	m = &Macro{
+		Name:         "exec",
+		TemplateText: renArgs["template"].(string),
+		Block:        true,
+		Ld:           "[[",
+		Rd:           "]]",
+		Sigils:       r.Doc.Sigils,
+	}
+	m.Parse(r.Doc.Folio.funcs)
 
 	// Apply the command's arguments to the macro.
 	s, err := r.ExecuteMacro(m, renArgs, false)
 	if err != nil {
 		// fmt.Println(err)
-		panic(RenderError{fmt.Sprintf("error rendering macro %q: %s", name, err)})
+		r.failf(n, err, "error rendering macro %q", name)
 	}
 	cmdLog.Copy().Add("name", name).Add("ld", m.Ld).Logf("executed macro, ready for parsing")
 
 	// Handle commands embedded in the macro.
 	// opts := &Options{Plain: true, Macros: r.macros}
-	output, err := ParseMacro(name, s, r.Doc, r.depth)
+	output, err := parseMacro(name, s, r.Doc, r.depth, m.Sigils)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: error in template for macro %q: %q", n.GetLineNum(), name, err)})
-	} else {
-		cmdLog.Copy().Add("nodes", output.Count()-1).LogfV(" macro, ready for rendering")
-		outs := r.render(output)
+		r.failf(n, err, "in output of macro %q", name)
+	}
 
-		if n.Block && !r.Doc.Plain {
-			items = append(items, r.MakeRenderItem(textItem, "\n"))
-			// outs = outs + "\n"
-		}
-		cobra.Tag("cmd").LogfV("end exec")
-		return outs
+	cmdLog.Copy().Add("nodes", output.Count()-1).LogfV(" macro, ready for rendering")
+	outs := r.render(output)
+
+	if n.Block && !r.Doc.Plain {
+		items = append(items, r.MakeRenderItem(textItem, "\n"))
+		// outs = outs + "\n"
 	}
+	cobra.Tag("cmd").LogfV("end exec")
+	return outs
 }
 
 func (r *Render) setRef(cmd *Cmd, flowStyle bool) {
@@ -382,12 +423,12 @@ func (r *Render) setRef(cmd *Cmd, flowStyle bool) {
 
 	d := r.getMacro(name, "")
 	if d == nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: system command %q not defined.", cmd.GetLineNum(), name)})
+		r.errorf(cmd, "system command %q not defined", name)
 	}
 
 	args, err := d.ValidateArgs(cmd, r.Doc)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: ValidateArgs failed on %s: %s", cmd.GetLineNum(), name, err)})
+		r.fail(cmd, err)
 	}
 
 	cobra.Tag("cmd").Strunc("syscmd", args["data"].String()).LogfV("system command: %s", args["data"])
@@ -400,31 +441,58 @@ func (r *Render) setRef(cmd *Cmd, flowStyle bool) {
 	}
 
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: unmarshall error for system command %q: %q", cmd.GetLineNum(), name, err)})
+		r.errorf(cmd, "unmarshall error for system command %q: %q", name, err)
+	}
+
+	// A ref names either its text or a counter whose number becomes the text.
+	label, ref := args["label"].String(), args["ref"].String()
+	switch counter := strings.TrimSpace(args["counter"].String()); {
+	case counter != "" && ref != "":
+		r.errorf(cmd, "refdef %q has both a ref and a counter", label)
+	case counter != "":
+		if ref, err = r.Doc.Counter(counter); err != nil {
+			r.fail(cmd, err)
+		}
+	case ref == "":
+		r.errorf(cmd, "refdef %q needs a ref or a counter", label)
 	}
 
-	r.Doc.Folio.SetData("ref."+args["label"].String(), args["ref"].String())
+	if err = r.Doc.Folio.defineRef(label, r.Doc, r.callerToken(cmd)); err != nil {
+		r.fail(cmd, err)
+	}
+	r.Doc.Folio.SetData("ref."+label, ref)
 
 	cobra.Tag("cmd").LogfV("end setRef")
 	return
 }
 
-func (r *Render) getRef(cmd *Cmd, flowStyle bool) (out string) {
+// getRef returns the label of the ref and true if it asks for a link to the
+// label rather than its text. The ref is rendered as a placeholder, so a macro
+// given a ref as an argument can pass it through but can't transform its
+// value with template functions.
+func (r *Render) getRef(cmd *Cmd) (label string, path bool) {
 	cobra.Tag("cmd").LogfV("begin getRef")
 	name := "sys.ref"
 
 	d := r.getMacro(name, "")
 	if d == nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: system command %q not defined.", cmd.GetLineNum(), name)})
+		r.errorf(cmd, "system command %q not defined", name)
 	}
 
 	args, err := d.ValidateArgs(cmd, r.Doc)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: ValidateArgs failed on %s: %s", cmd.GetLineNum(), name, err)})
+		r.fail(cmd, err)
 	}
 
 	cobra.Tag("cmd").Strunc("syscmd", args["data"].String()).LogfV("system command: %s", args["data"])
-	out = "ref." + args["label"].String()
+	label = args["label"].String()
+	switch as := args["as"].String(); as {
+	case "text":
+	case "path":
+		path = true
+	default:
+		r.errorf(cmd, "ref can't be shown as %q, use text or path", as)
+	}
 
 	// if ref, found := r.Doc.Folio.Data["ref."+args["label"].String()]; !found {
 	// 	panic(RenderError{message: fmt.Sprintf("line %d: ref '%s' was not found", cmd.GetLineNum(), args["label"].String())})
@@ -443,12 +511,12 @@ func (r *Render) setData(n *Cmd, flowStyle bool) {
 	// Retrieve the sys.data system command
 	d := r.getMacro(name, "")
 	if d == nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: system command %q not defined.", n.GetLineNum(), name)})
+		r.errorf(n, "system command %q not defined", name)
 	}
 
 	args, err := d.ValidateArgs(n, r.Doc)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: ValidateArgs failed on setData %q: %q", n.GetLineNum(), name, err)})
+		r.fail(n, err)
 	}
 
 	cobra.Tag("cmd").Strunc("syscmd", args["data"].String()).LogfV("system command: %s", args["data"])
@@ -461,11 +529,11 @@ func (r *Render) setData(n *Cmd, flowStyle bool) {
 	}
 
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: unmarshall error for system command %q: %q", n.GetLineNum(), name, err)})
+		r.errorf(n, "unmarshall error for system command %q: %q", name, err)
 	}
 
 	for k, v := range data {
-		Data[k.(string)] = v
+		r.Doc.Folio.SetData(k.(string), v)
 	}
 
 	cobra.Tag("cmd").LogfV("end setData")
@@ -495,7 +563,7 @@ func (c cmdArgs) FlagSet(s string) bool {
 func newCmdArgs(d *Document) (c cmdArgs) {
 	c = make(cmdArgs)
 	c["Doc"] = d
-	c["Data"] = d.Folio.Data
+	c["Data"] = d.Folio.copyData()
 	// c["Body"] = d.Output
 	return
 }
@@ -507,19 +575,20 @@ func newCmdArgs(d *Document) (c cmdArgs) {
 func (r *Render) processPageTemplate(n *Cmd) string {
 	name := n.GetCmdName()
 	r.pushContext(name)
+	r.pushCall(n)
 	cobra.Tag("render").WithField("cmd", name).LogV("rendering page template (cmd)")
 	cmdLog := cobra.Tag("cmd")
 
 	// Get the macro definition.
 	m := r.getMacro(name, n.Format)
 	if m == nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: macro %q (format %q) not defined.", n.GetLineNum(), name, n.Format)})
+		r.errorf(n, "macro %q (format %q) not defined", name, n.Format)
 	}
 	cmdLog.Copy().Strunc("macro", m.TemplateText).LogfV("retrieved macro definition")
 
-	mac, err := ParseMacro(name, m.TemplateText, r.Doc, r.depth)
+	mac, err := parseMacro(name, m.TemplateText, r.Doc, r.depth, m.Sigils)
 	if err != nil {
-		panic(RenderError{message: fmt.Sprintf("Line %d: error in page template %q: %q", n.GetLineNum(), name, err)})
+		r.failf(n, err, "in page template %q", name)
 	}
 
 	// render the macro and parse the resulting template
@@ -529,7 +598,7 @@ func (r *Render) processPageTemplate(n *Cmd) string {
 	for _, i := range rd {
 		tmplt.WriteString(i.String())
 	}
-	t := template.Must(template.New(name).Funcs(funcMap).Delims("[[", "]]").Option("missingkey=error").Parse(tmplt.String()))
+	t := template.Must(template.New(name).Funcs(r.Doc.Folio.funcs).Delims("[[", "]]").Option("missingkey=error").Parse(tmplt.String()))
 
 	// execute the template
 	s := strings.Builder{}
@@ -537,14 +606,126 @@ func (r *Render) processPageTemplate(n *Cmd) string {
 	data["Body"] = r.Doc.Output
 	err = t.Delims(m.Ld, m.Rd).Option("missingkey=error").Execute(&s, data)
 	if err != nil {
-		panic(RenderError{fmt.Sprintf("error executing page template %q: %s", name, err)})
+		r.failf(n, err, "error executing page template %q", name)
 	}
 
+	r.popCall()
 	r.popContext()
 
 	return s.String()
 }
 
+// errorf stops rendering with a Diagnostic located at the command.
+func (r *Render) errorf(n *Cmd, format string, args ...interface{}) {
+	panic(r.diagnose(n, fmt.Errorf(format, args...)))
+}
+
+// fail stops rendering with err located at the command.
+func (r *Render) fail(n *Cmd, err error) {
+	panic(r.diagnose(n, err))
+}
+
+// failf stops rendering with err located at the command. The message is
+// prefixed with the formatted text unless err already has a location.
+func (r *Render) failf(n *Cmd, err error, format string, args ...interface{}) {
+	if d, ok := err.(*Diagnostic); ok && d.located {
+		panic(r.diagnose(n, d))
+	}
+	prefix := fmt.Sprintf(format, args...)
+	panic(r.diagnose(n, fmt.Errorf("%s: %s", prefix, diagnosticMessage(err))))
+}
+
+// renderCmd renders a command. When the Folio keeps going after errors, an
+// error in the command is recorded and the command renders as nothing.
+func (r *Render) renderCmd(c *Cmd) (items []RenderItem) {
+	if r.keepGoing() {
+		depth, context, calls := r.depth, len(r.context), len(r.calls)
+		defer func() {
+			if e := recover(); e != nil {
+				r.collect(c, e)
+				r.depth, r.context, r.calls = depth, r.context[:context], r.calls[:calls]
+				items = nil
+			}
+		}()
+	}
+
+	if c.SysCmd {
+		return r.processSysCmd(c)
+	}
+
+	items = r.processCmd(c)
+	if r.Doc.Footnotes == "paragraph" && c.GetCmdName() == "paragraph.end" {
+		// The footnotes follow the paragraph that refers to them.
+		items = append(items, r.flushNotes(c, footnote)...)
+	}
+	return
+}
+
+// keepGoing returns true if errors are collected instead of stopping the
+// render.
+func (r *Render) keepGoing() bool {
+	return r.Doc.Folio != nil && r.Doc.Folio.KeepGoing
+}
+
+// collect records the error recovered while rendering n. Values that aren't
+// rendering errors are passed on.
+func (r *Render) collect(n *Cmd, e interface{}) {
+	switch e.(type) {
+	case RenderError, Error, *Diagnostic:
+		d := r.diagnose(n, e.(error))
+		cobra.Tag("render").WithField("error", d.Error()).LogV("recording error")
+		r.diags = append(r.diags, d)
+	default:
+		panic(e)
+	}
+}
+
+// diagnose converts err into a Diagnostic. Problems in text generated by a
+// macro are reported at the command in the source file that called the
+// macro.
+func (r *Render) diagnose(n *Cmd, err error) *Diagnostic {
+	d, ok := err.(*Diagnostic)
+	if !ok {
+		d = &Diagnostic{Severity: SeverityError, Message: err.Error()}
+	}
+
+	if !d.located {
+		d.locate(r.callerToken(n))
+	}
+
+	if d.Stack == nil && len(r.context) > 0 {
+		d.Stack = append([]string{}, r.context...)
+	}
+
+	return d
+}
+
+// callerToken returns the token of n, or of the innermost command being
+// rendered, that comes from a source file rather than from generated text.
+func (r *Render) callerToken(n *Cmd) *token {
+	if n.hasSourceToken() {
+		return n.cmdToken
+	}
+
+	for i := len(r.calls) - 1; i >= 0; i-- {
+		if r.calls[i].hasSourceToken() {
+			return r.calls[i].cmdToken
+		}
+	}
+
+	return nil
+}
+
+func (r *Render) pushCall(n *Cmd) {
+	r.calls = append(r.calls, n)
+}
+
+func (r *Render) popCall() {
+	if l := len(r.calls); l > 0 {
+		r.calls = r.calls[:l-1]
+	}
+}
+
 func (r *Render) pushContext(s string) {
 	r.context = append(r.context, s)
 }
@@ -565,7 +746,10 @@ func (r *Render) ExecuteMacro(m *Macro, data cmdArgs, init bool) (string, error)
 	if init {
 		t = m.InitTemplate
 	}
-	err := t.Delims(m.Ld, m.Rd).Option("missingkey=error").Execute(&s, data)
+	// The delimiters and options were set when the template was parsed.
+	// Setting them again here would modify a template that may be shared by
+	// concurrent renders.
+	err := t.Execute(&s, data)
 	if err != nil {
 		return "", err
 	}
@@ -15,6 +15,9 @@
 package core
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -194,6 +197,83 @@ hello world
 	}
 }
 
+func TestRenderBlockComment(t *testing.T) {
+	testText := `>>>
+mode: plain
+---
+one ◊[ •nosuch{x}
+
+◊[ nested •&(missing.st) ]◊
+
+]◊two
+`
+	f := NewFolio()
+	d := NewDoc("testname", "testpath")
+	d.Text = testText
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "one two\n"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestRenderBlockCommentUnclosed(t *testing.T) {
+	// Without a closing ]◊ anywhere after it, ◊[ begins a line comment just as
+	// it did before block comments were added.
+	testText := `>>>
+mode: plain
+---
+one ◊[ •nosuch{x}
+two
+`
+	f := NewFolio()
+	d := NewDoc("testname", "testpath")
+	d.Text = testText
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "one two\n"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestRenderVerbatim(t *testing.T) {
+	testText := `>>>
+mode: plain
+---
+•(newmacro){
+    name: code
+    template: "<[[.text]]>"
+    parameters: [text]
+}
+a •` + "``•x{y}◊ `z` }``•" + ` b •code{•` + "`{ •`•} c\n"
+	f := NewFolio()
+	d := NewDoc("testname", "testpath")
+	d.Text = testText
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	exp := "\na •x{y}◊ `z` } b <{ •> c\n"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
 func TestRenderData(t *testing.T) {
 	testText := `
 •(exec){[[ setdata "greeting" "hello" ]]}
@@ -348,3 +428,167 @@ hello •(ref){this}
 		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
 	}
 }
+
+func TestRenderForwardRef(t *testing.T) {
+	macrodef := `•(newmacro){
+    name: upper
+    parameters: [text]
+    template: '[[ .text | printf "%s!" ]]'
+}`
+
+	f := NewFolio()
+	if err := f.loadMacros("macrodef", "", macrodef); err != nil {
+		t.Fatalf("loadMacros: unexpected error: %s", err)
+	}
+
+	d1 := NewDoc("doc1", "path1")
+	d1.Text = "see •upper{•echo{•(ref){this}} and •(ref){that}}\n•(refdef)[{this}{here}]"
+	d2 := NewDoc("doc2", "path2")
+	d2.Text = "•(refdef)[{that}{there}]"
+	f.AppendDoc(d1)
+	f.AppendDoc(d2)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "<see here and there!\n>\n\n"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestRenderRefInTemplateFunc(t *testing.T) {
+	macrodef := `•(newmacro){
+    name: up
+    parameters: [x]
+    template: '[[upper .x]]|[[len .x]]'
+}
+•(newmacro){
+    name: pass
+    parameters: [x]
+    template: '([[ trimspace .x ]])'
+}`
+
+	tests := []struct {
+		text, exp string
+	}{
+		{"•up{•(ref){l}}", `upper can't be given a ref`},
+		{"•up{abc}", ""},
+		{"•pass{ •(ref){l} }", ""},
+	}
+
+	for _, tc := range tests {
+		f := NewFolio()
+		if err := f.loadMacros("macrodef", "", macrodef); err != nil {
+			t.Fatalf("loadMacros: unexpected error: %s", err)
+		}
+		d := NewDoc("testname", "testpath")
+		d.Text = tc.text + "\n•(refdef)[{l}{abc}]"
+		d.Plain = true
+		f.AppendDoc(d)
+
+		out, err := f.MakeDocs()
+		switch {
+		case tc.exp == "" && err != nil:
+			t.Errorf("%q: unexpected error: %s", tc.text, err)
+		case tc.exp != "" && (err == nil || !strings.Contains(err.Error(), tc.exp)):
+			t.Errorf("%q\nExpected: %s\n     Got: %v (%q)", tc.text, tc.exp, err, out)
+		}
+	}
+}
+
+func TestRenderRefPath(t *testing.T) {
+	f := NewFolio()
+	d1 := NewDoc("a.st", "src/a.st")
+	d1.Text = "see •(ref)[label={intro} as={path}] •(ref)[label={top} as={path}]\n•(refdef)[{top}{Top}]"
+	d1.OutputPath = "a.html"
+	d2 := NewDoc("intro.st", "src/guide/intro.st")
+	d2.Text = "see •(ref)[label={top} as={path}]\n•(refdef)[label={intro} ref={Introduction}]"
+	d2.OutputPath = "guide/intro.html"
+	f.AppendDoc(d1)
+	f.AppendDoc(d2)
+
+	for _, d := range f.GetDocs() {
+		if _, err := d.MakeDeferred(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	tests := []struct {
+		doc  *Document
+		exp  string
+		refs []string
+	}{
+		{d1, "<see guide/intro.html#intro #top\n>\n", []string{"src/guide/intro.st"}},
+		{d2, "<see ../a.html#top\n>\n", []string{"src/a.st"}},
+	}
+
+	for _, tc := range tests {
+		out, err := tc.doc.ResolveRefs()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.doc.Name, err)
+		}
+		if out != tc.exp {
+			t.Errorf("%s\nExpected: %q\n     Got: %q", tc.doc.Name, tc.exp, out)
+		}
+		if fmt.Sprint(tc.doc.Refs) != fmt.Sprint(tc.refs) {
+			t.Errorf("%s: expected refs %v, got %v", tc.doc.Name, tc.refs, tc.doc.Refs)
+		}
+	}
+}
+
+func TestRenderConcurrent(t *testing.T) {
+	var err error
+	macrodef := `•(newmacro){
+    name: greet
+    parameters: ["who"]
+    template: '[[ getdata "greeting" "hello" ]] [[ .who ]]'
+}`
+	doctext := `
+•(newmacro){
+    name: local%[1]d
+    template: local
+}
+•(exec){[[ setdata "key%[1]d" "%[1]d" ]]}
+•greet{doc%[1]d} •local%[1]d •(ref){this%[1]d}
+•(refdef)[{this%[1]d}{ref%[1]d}]
+`
+
+	f := NewFolio()
+	err = f.loadMacros("macrodef", "", macrodef)
+	if err != nil {
+		t.Errorf("loadMacros: unexepected error: %s", err)
+	}
+
+	n := 20
+	for i := 0; i < n; i++ {
+		d := NewDoc(fmt.Sprintf("doc%d", i), fmt.Sprintf("path%d", i))
+		d.Text = fmt.Sprintf(doctext, i)
+		f.AppendDoc(d)
+	}
+
+	var wg sync.WaitGroup
+	out := make([]string, n)
+	errs := make([]error, n)
+	for i, d := range f.GetDocs() {
+		wg.Add(1)
+		go func(i int, d *Document) {
+			defer wg.Done()
+			out[i], errs[i] = d.Make()
+		}(i, d)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Errorf("doc%d: unexpected error: %s", i, errs[i])
+		}
+
+		exp := fmt.Sprintf("<hello doc%[1]d local ref%[1]d\n>\n", i)
+		if out[i] != exp {
+			t.Errorf("\nExpected: %q\n     Got: %q", exp, out[i])
+		}
+	}
+}
@@ -16,7 +16,6 @@ package core
 
 import (
 	"fmt"
-	"io/ioutil"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -104,6 +103,8 @@ type token struct {
 	loc    Loc       // The starting location of this token's text.
 	lnum   int       // The line number of Loc.
 	value  string    // This token's text.
+	file   *scanFile // The file containing the token.
+	depth  int       // The command nesting depth when the token was emitted.
 }
 
 func (t token) String() string {
@@ -115,7 +116,6 @@ func (t token) String() string {
 	default:
 		return fmt.Sprintf("       %s: %q\n", tokenTypeLookup(t.typeof), t.value)
 	}
-	return ""
 }
 
 // ----------------------------------------------------------------------------
@@ -133,30 +133,39 @@ const (
 type Loc int
 
 type scanFile struct {
-	doc   *Document // the Document being scanned
-	name  string    // name of the doc being scanned
-	input string    // the string being scanned
-	pos   Loc       // current position in the input
-	start Loc       // start position of this item
-	line  int       // number of newlines seen (starts at 1)
+	doc    *Document // the Document being scanned
+	name   string    // name of the doc being scanned
+	path   string    // path reported in diagnostics, empty for generated text
+	input  string    // the string being scanned
+	pos    Loc       // current position in the input
+	start  Loc       // start position of this item
+	line   int       // number of newlines seen (starts at 1)
+	queued bool      // true if the file is waiting for an earlier import to finish
 }
 
 // scanner represents the current state.
 type scanner struct {
 	*scanFile                // the current file being scanned
 	fileStack    []*scanFile // stack of files waiting for scans
-	cmdH         string      // rune indicating a horizontal-mode command
-	cmdV         string      // rune indicating a vertical-mode command
-	comment      string      // rune indicating EOL comment
-	parCmd       string      // rune indicating a paragraph command
+	cmdH         string      // sigil indicating a horizontal-mode command
+	cmdV         string      // sigil indicating a vertical-mode command
+	comment      string      // sigil indicating EOL comment
+	parCmd       string      // sigil indicating a paragraph command
 	width        Loc         // width of last rune read from input
-	tokens       chan token  // channel of scanned tokens
+	state        ƒ           // the next state, nil when the scan is done
+	tokens       []token     // tokens scanned but not yet returned
+	head         int         // index of the next token to return
 	cmdDepth     int         // nesting depth of commands
 	altTerm      bool        // true if '*}' terminates a text block
 	init         bool        // true if in init mode
 	skipConfig   bool
 	scanLiterals bool // true if the scanner should convert literals to final text
 	inMacroDef   bool // true when scanning inside a macro definition
+	imported     bool // true if the input imported a file
+	noImports    bool // true if imports are skipped rather than opened
+	keepGoing    bool // true if the scan continues after an error
+	// contexts holds the command contexts that are open, innermost last.
+	contexts []cmdContext
 	// cmdStack indicates if a command's text block was called from within a
 	// full command (with a context) or from a short command.
 	cmdStack           []*cmdAttrs
@@ -181,11 +190,6 @@ func NewScanner(name, input string, plain bool, d *Document) (s *scanner) {
 			line:  1,
 		},
 		fileStack:    []*scanFile{},
-		cmdH:         "•",
-		cmdV:         "§",
-		comment:      "◊",
-		parCmd:       "¶",
-		tokens:       make(chan token),
 		parMode:      true,
 		parScannerOn: true,
 		parScanFlag:  true,
@@ -199,9 +203,25 @@ func NewScanner(name, input string, plain bool, d *Document) (s *scanner) {
 		s.parOpen = false
 	}
 
+	if d != nil {
+		s.setSigils(d.Sigils)
+		s.keepGoing = d.Folio != nil && d.Folio.KeepGoing
+	} else {
+		s.setSigils(DefaultSigils)
+	}
+
 	return
 }
 
+// setSigils sets the sigils recognized by the scanner.
+func (s *scanner) setSigils(sigils Sigils) {
+	sigils = sigils.resolve()
+	s.cmdH = sigils.Cmd
+	s.cmdV = sigils.VCmd
+	s.comment = sigils.Comment
+	s.parCmd = sigils.Par
+}
+
 type cmdAttrs struct {
 	extended        bool // true if the command includes the full body
 	altTerm         bool // true if '*}' terminates a text block
@@ -209,6 +229,13 @@ type cmdAttrs struct {
 	blockModeChange bool
 }
 
+// cmdContext is the context of a full command, which begins with [.
+type cmdContext struct {
+	file  *scanFile // the file holding the [
+	blank Loc       // the line break before the first blank line in the context, or -1
+	line  int       // the line number of blank
+}
+
 type cmdType int
 
 const (
@@ -223,6 +250,7 @@ const (
 func scan(d *Document) *scanner {
 	cobra.Tag("scan").WithField("name", d.Name).Add("plain", d.Plain).LogV("scanning input (scan)")
 	s := NewScanner(d.Name, d.Text, d.Plain, d)
+	s.path = d.Path
 	s.pos = Loc(d.contentBegin)
 	s.start = Loc(d.contentBegin)
 	s.scanLiterals = true
@@ -230,9 +258,10 @@ func scan(d *Document) *scanner {
 }
 
 // scanMacro
-func scanMacro(name, input string, d *Document, depth int) *scanner {
+func scanMacro(name, input string, d *Document, depth int, sigils Sigils) *scanner {
 	cobra.Tag("scan").WithField("name", d.Name).Add("plain", d.Plain).LogV("scanning input (scan)")
 	s := NewScanner(name, input, true, d)
+	s.setSigils(sigils)
 
 	// Scan literals if the output is not inside another macro.
 	if depth <= 1 {
@@ -255,19 +284,21 @@ func scanMacro(name, input string, d *Document, depth int) *scanner {
 // }
 
 // scanWith allows the use of an externally created and configured scanner.
+// The scan runs as the parser asks for tokens.
 func scanWith(s *scanner) *scanner {
-	go s.run()
+	cobra.Tag("scan").Tag("scan").LogV("start scanning")
+	s.state = scanStart
 	return s
 }
 
-// run runs the state machine for the scanner.
+// run advances the state machine until it emits a token or stops.
 func (s *scanner) run() {
-	cobra.Tag("scan").Tag("scan").LogV("start scanning")
-	for state := scanStart; state != nil; {
-		state = state(s)
+	for s.head == len(s.tokens) && s.state != nil {
+		s.state = s.state(s)
+		if s.state == nil {
+			cobra.Tag("scan").LogV("done scanning")
+		}
 	}
-	close(s.tokens)
-	cobra.Tag("scan").LogV("done scanning")
 }
 
 func (s *scanner) pushScanFile(sf *scanFile) {
@@ -281,6 +312,7 @@ func (s *scanner) popScanFile() *scanFile {
 	}
 	sf := s.fileStack[l-1]
 	s.fileStack = s.fileStack[:l-1]
+	sf.queued = false
 	return sf
 }
 
@@ -364,11 +396,33 @@ func (s *scanner) popCmd() (m *cmdAttrs) {
 	return
 }
 
-// isCmdCmd returns true if the rune is a cmd character.
-func (s *scanner) isCmdCmd(r rune) bool {
-	cmdH, _ := utf8.DecodeRuneInString(s.cmdH)
-	cmdV, _ := utf8.DecodeRuneInString(s.cmdV)
-	return r == cmdH || r == cmdV
+// atSigil returns true if the rune just returned by next begins sigil.
+func (s *scanner) atSigil(sigil string) bool {
+	return strings.HasPrefix(s.input[s.pos-s.width:], sigil)
+}
+
+// skipSigil consumes the rest of the sigil whose first rune was just
+// returned by next. Don't call backup afterwards.
+func (s *scanner) skipSigil(sigil string) {
+	s.pos += Loc(len(sigil)) - s.width
+}
+
+// isCmdCmd returns true if the rune just returned by next begins a command
+// sigil.
+func (s *scanner) isCmdCmd() bool {
+	return s.atSigil(s.cmdH) || s.atSigil(s.cmdV)
+}
+
+// isVerbatim returns true if the rune just returned by next begins a command
+// sigil that starts a verbatim block.
+func (s *scanner) isVerbatim() bool {
+	for _, sigil := range []string{s.cmdH, s.cmdV} {
+		if s.atSigil(sigil) {
+			i := s.pos - s.width + Loc(len(sigil))
+			return strings.HasPrefix(s.input[i:], "`")
+		}
+	}
+	return false
 }
 
 // getCmdMode returns an "H" if the command should be interpreted in
@@ -381,10 +435,15 @@ func (s *scanner) getCmdMode() string {
 	}
 }
 
-// setCmdMode sets the command mode.
-func (s *scanner) setCmdMode(r rune) {
-	hcmd, _ := utf8.DecodeRuneInString(s.cmdH)
-	s.horizMode = r == hcmd
+// setCmdMode consumes the command sigil and sets the command mode.
+func (s *scanner) setCmdMode() {
+	s.next()
+	s.horizMode = s.atSigil(s.cmdH)
+	if s.horizMode {
+		s.skipSigil(s.cmdH)
+	} else {
+		s.skipSigil(s.cmdV)
+	}
 }
 
 // isHorizCmd returns true if it is a horizontal mode command.
@@ -392,10 +451,14 @@ func (s *scanner) isHorizCmd() bool {
 	return s.horizMode
 }
 
-// isComment returns true if the rune is the EOL comment character.
-func (s *scanner) isComment(r rune) bool {
-	q, _ := utf8.DecodeRuneInString(s.comment)
-	return r == q
+// isComment returns true if the rune just returned by next begins the EOL
+// comment sigil. The rest of the sigil is consumed.
+func (s *scanner) isComment() bool {
+	if s.width == 0 || !s.atSigil(s.comment) {
+		return false
+	}
+	s.skipSigil(s.comment)
+	return true
 }
 
 // next returns the next rune in the input.
@@ -496,43 +559,90 @@ func (s *scanner) forget() {
 	s.start = s.pos
 }
 
-// errorf returns an error token and terminates the scan by passing
-// back a nil pointer that will be the next state, terminating s.nextToken.
+// errorf sends an error token and returns the state that follows the error.
+// Unless errors are collected, that is a nil pointer that terminates the scan.
 func (s *scanner) errorf(format string, args ...interface{}) ƒ {
 	cobra.Tag("scan").LogV("errorf: %q", fmt.Sprintf(format, args...))
-	s.tokens <- token{
+	s.send(token{
 		typeof: tokenError,
 		loc:    s.start,
 		lnum:   s.line,
-		value:  fmt.Sprintf(format, args...)}
-	return nil
+		value:  fmt.Sprintf(format, args...),
+		file:   s.scanFile,
+		depth:  s.cmdDepth})
+	return s.resume()
 }
 
-// nextToken returns the next token from the input.
-// Called by the parser, not in the scanning goroutine.
+// resume returns the state in which the scan continues after an error: nil
+// to stop the scan, or scanText when errors are collected.
+func (s *scanner) resume() ƒ {
+	if !s.keepGoing {
+		return nil
+	}
+	return scanText
+}
+
+// contextErrorf sends an error token for an error found in a command's
+// context and returns the state that follows the error.
+func (s *scanner) contextErrorf(format string, args ...interface{}) ƒ {
+	s.errorf(format, args...)
+	return s.resumeContext()
+}
+
+// resumeContext is like resume for an error found in a command's context.
+// When errors are collected, the rest of the context is skipped.
+func (s *scanner) resumeContext() ƒ {
+	if !s.keepGoing {
+		return nil
+	}
+	return skipContext
+}
+
+// nextToken returns the next token from the input, scanning more of the
+// input when every scanned token has been returned.
 func (s *scanner) nextToken() token {
-	return <-s.tokens
+	if s.head == len(s.tokens) {
+		s.tokens, s.head = s.tokens[:0], 0
+		s.run()
+		if len(s.tokens) == 0 {
+			// The scan stopped early after reporting an error.
+			return token{typeof: tokenEOF}
+		}
+	}
+
+	t := s.tokens[s.head]
+	s.head++
+	return t
+}
+
+// send queues a token for the parser.
+func (s *scanner) send(t token) {
+	s.tokens = append(s.tokens, t)
 }
 
 // emitInsertedToken creates a token with the given value (which wasn't found
 // in the source text) and sends it to the client.
 func (s *scanner) emitInsertedToken(t tokenType, val string) {
 	cobra.Tag("tokens").WithField("type", tokenTypeLookup(t)).Strunc("value", val).LogfV("emitInsertedToken")
-	s.tokens <- token{
+	s.send(token{
 		typeof: t,
 		loc:    s.start,
 		lnum:   s.line,
-		value:  val}
+		value:  val,
+		file:   s.scanFile,
+		depth:  s.cmdDepth})
 }
 
 // emitRawToken passes a token to the client.
 func (s *scanner) emitRawToken(t tokenType) {
 	cobra.Tag("tokens").Strunc("value", string(s.input[s.start:s.pos])).Add("type", tokenTypeLookup(t)).LogfV("emitRawToken")
-	s.tokens <- token{
+	s.send(token{
 		typeof: t,
 		loc:    s.start,
 		lnum:   s.line,
-		value:  s.input[s.start:s.pos]}
+		value:  s.input[s.start:s.pos],
+		file:   s.scanFile,
+		depth:  s.cmdDepth})
 	s.start = s.pos
 }
 
@@ -558,11 +668,13 @@ func (s *scanner) emit(t tokenType) {
 // emitSysCmd passes a system command token to the client.
 func (s *scanner) emitSysCmd(t tokenType, args string) {
 	cobra.Tag("tokens").Strunc("value", string(s.input[s.start:s.pos])).LogfV("emitSysCmd")
-	s.tokens <- token{
+	s.send(token{
 		typeof: t,
 		loc:    s.start,
 		lnum:   s.line,
-		value:  args}
+		value:  args,
+		file:   s.scanFile,
+		depth:  s.cmdDepth})
 	s.start = s.pos
 }
 
@@ -634,10 +746,11 @@ Loop:
 					s.emit(tokenIndent)
 				}
 			}
-		case r == '¶':
+		case s.atSigil(s.parCmd):
 			s.backup()
 			s.emit(tokenText)
 			s.next()
+			s.skipSigil(s.parCmd)
 			switch nxt := s.next(); {
 			case nxt == '+':
 				cobra.Tag("scan").Add("line", s.line).LogV("encountered ¶+")
@@ -646,7 +759,7 @@ Loop:
 				cobra.Tag("scan").Add("line", s.line).LogV("encountered ¶-")
 				s.emit(tokenParScanOff)
 			default:
-				s.errorf("character %q not a valid character to follow ¶", nxt)
+				s.errorf("character %q not a valid character to follow %s", nxt, s.parCmd)
 			}
 		case r == '`':
 			// Literals are converted to text only when we are not inside a
@@ -678,17 +791,29 @@ Loop:
 				s.emit(tokenRightCurly)
 				return s.exitTextBlock()
 			}
-		case s.isCmdCmd(r) && !s.inMacroDef:
+		case s.inMacroDef && s.isVerbatim():
+			// Commands aren't scanned in macro definitions, but verbatim
+			// blocks are so that their braces don't end the definition.
+			s.backup()
+			s.emit(tokenText)
+			return scanNewCommand
+		case !s.inMacroDef && s.isCmdCmd():
 			s.backup()
 			s.emit(tokenText)
 			return scanNewCommand
-		case s.isComment(r):
+		case s.atSigil(s.comment):
 			cobra.Tag("scan").Add("line", s.line).LogV("eol comment")
 			s.backup()
 			s.emit(tokenText)
 			s.next()
+			s.skipSigil(s.comment)
+			if s.atBlockComment() {
+				if !s.skipBlockComment() {
+					return s.resume()
+				}
+				continue
+			}
 			s.emit(tokenComment)
-			// scanCommentToggle(s)
 		case isEndOfFile(r):
 			cobra.Tag("scan").Add("line", s.line).LogV("eof encountered")
 			if s.cmdDepth > 0 {
@@ -718,18 +843,47 @@ Loop:
 	return nil
 }
 
-// Scans for ◊ characters which toggles comments.
-func scanCommentToggle(s *scanner) {
-	// input:  text◊...◊text
-	// s.pos:      ^
-	s.jumpNextRune()
-	i := strings.Index(s.input[s.pos:], "◊")
-	if i < 0 {
-		s.jump(len(s.input[s.pos:]))
-		return
+// atBlockComment reports whether the comment sigil just consumed opens a
+// block comment. It does if it's followed by [ and a ] followed by the
+// comment sigil appears somewhere later in the input. Otherwise it's a line
+// comment that happens to begin with [, as comments were before block
+// comments were added.
+func (s *scanner) atBlockComment() bool {
+	return s.peek() == '[' && strings.Contains(s.input[s.pos:], "]"+s.comment)
+}
+
+// skipBlockComment skips a block comment. A block comment starts with the
+// comment sigil followed by [ and ends with ] followed by the comment sigil,
+// as in ◊[...]◊. Block comments nest. Nothing inside a block comment is
+// scanned, so its commands and imports are ignored. The comment sigil has
+// already been consumed. It returns false if the comment isn't terminated.
+func (s *scanner) skipBlockComment() bool {
+	// input:  text◊[...]◊text
+	// s.pos:       ^
+	begin := s.pos - Loc(len(s.comment))
+	open, close := s.comment+"[", "]"+s.comment
+	s.next()
+
+	for depth := 1; depth > 0; {
+		rest := s.input[s.pos:]
+		i, j := strings.Index(rest, open), strings.Index(rest, close)
+		switch {
+		case j < 0:
+			s.start = begin
+			s.errorf("block comment is not terminated")
+			return false
+		case i >= 0 && i < j:
+			depth++
+			s.pos += Loc(i + len(open))
+		default:
+			depth--
+			s.pos += Loc(j + len(close))
+		}
 	}
-	s.jump(i + len("◊"))
-	return
+
+	cobra.Tag("scan").Add("line", s.line).LogV("skipped block comment")
+	s.ignore()
+	return true
 }
 
 // scanCommand creates a cmd token.
@@ -742,9 +896,8 @@ func scanNewCommand(s *scanner) ƒ {
 	// input:   •cmd[...]
 	// s.pos:  ^
 	cobra.Tag("scan").Add("line", s.line).LogV("scanNewCommand")
-	cr := s.next()
+	s.setCmdMode()
 	s.ignore()
-	s.setCmdMode(cr)
 
 	// Determine the command
 	switch r := s.peek(); {
@@ -776,6 +929,14 @@ func scanNewCommand(s *scanner) ƒ {
 			return scanText
 		}
 
+		var cond string
+		if s.peek() == '[' {
+			var ok bool
+			if cond, ok = scanImportCondition(s); !ok {
+				return s.resume()
+			}
+		}
+
 		if r = s.next(); r != '(' {
 			return s.errorf("illegal character, %q, found at start of file import", r)
 		}
@@ -783,30 +944,60 @@ func scanNewCommand(s *scanner) ƒ {
 
 		fn := scanFileName(s)
 
-		if r = s.next(); r != ')' {
+		switch r = s.next(); {
+		case isEndOfFile(r):
+			return s.errorf("encountered end of file while reading file name")
+		case r != ')':
 			return s.errorf("illegal character, %q, found at end of file import", r)
 		}
 		s.ignore()
 
+		skip := scanText
 		if s.peek() == '%' {
 			s.next()
 			s.emit(tokenSpaceEater)
+			skip = scanStart
+		}
+
+		if s.noImports {
+			return skip
 		}
 
-		in, err := ioutil.ReadFile(fn)
+		// The outcome depends on more than the input, so the result can't be
+		// cached even if nothing is imported.
+		s.imported = true
+
+		if cond != "" {
+			want, err := s.importWanted(cond)
+			if err != nil {
+				return s.errorf("%s", err)
+			}
+			if !want {
+				cobra.Tag("scan").Add("name", fn).Add("condition", cond).LogV("skipping import")
+				return skip
+			}
+		}
+
+		files, err := s.importFiles(fn)
 		if err != nil {
-			return s.errorf("unable to read file %q", fn)
+			return s.errorf("%s", err)
 		}
 
-		sf := &scanFile{
-			name:  fn,
-			input: string(in),
-			line:  1,
+		for _, sf := range files {
+			if s.doc != nil {
+				s.doc.addImport(sf.path)
+			}
 		}
 
+		// Files matched by a pattern wait on the stack, after the current
+		// file, in the order they are scanned.
 		cobra.Tag("scan").Add("name", fn).LogV("opening new file")
 		s.pushScanFile(s.scanFile)
-		s.scanFile = sf
+		for i := len(files) - 1; i > 0; i-- {
+			files[i].queued = true
+			s.pushScanFile(files[i])
+		}
+		s.scanFile = files[0]
 
 		return scanStart
 	case r == '(':
@@ -845,6 +1036,9 @@ func scanNewCommand(s *scanner) ƒ {
 
 		cobra.Tag("scan").LogV("done scanning bare system command")
 		return scanText
+	case r == '`':
+		cobra.Tag("scan").LogV("verbatim block")
+		return scanVerbatim
 	case r == '%': // space eater
 		cobra.Tag("scan").Add("line", s.line).LogV("eating spaces")
 		s.next()
@@ -863,8 +1057,48 @@ func scanNewCommand(s *scanner) ƒ {
 	default:
 		return s.errorf("character %q not a valid command character", r)
 	}
-	// If we somehow get here, just say no.
-	return s.errorf("illegal character, %q, found in command", s.next())
+}
+
+// scanVerbatim scans a verbatim block. A verbatim block starts with a command
+// sigil followed by one or more backticks and ends with the same number of
+// backticks followed by the same sigil, as in •`...`• or •``...``•. Nothing
+// inside the block is scanned, so it may hold sigils, braces, and runs of
+// backticks shorter than its fence.
+//
+// Like literals, the fences are removed only when we are not inside a
+// command. Otherwise the whole block is passed along as text so that it is
+// still verbatim when the macro's output is scanned.
+func scanVerbatim(s *scanner) ƒ {
+	// input:  •```...```•
+	// s.pos:   ^
+	sigil := s.cmdV
+	if s.isHorizCmd() {
+		sigil = s.cmdH
+	}
+	begin := s.start - Loc(len(sigil))
+
+	s.acceptRun("`")
+	end := s.input[s.start:s.pos] + sigil
+	i := strings.Index(s.input[s.pos:], end)
+	if i < 0 {
+		s.start = begin
+		return s.errorf("verbatim block is not terminated")
+	}
+
+	if s.scanLiterals && s.cmdDepth == 0 {
+		s.ignore()
+		s.pos += Loc(i)
+		s.line += strings.Count(s.input[s.start:s.pos], "\n")
+		s.emit(tokenText)
+		s.jump(len(end))
+	} else {
+		s.start = begin
+		s.pos += Loc(i + len(end))
+		s.line += strings.Count(s.input[s.start:s.pos], "\n")
+		s.emit(tokenText)
+	}
+
+	return scanText
 }
 
 func scanShortCmd(s *scanner) ƒ {
@@ -886,9 +1120,9 @@ func scanShortCmd(s *scanner) ƒ {
 			s.emit(tokenRightCurly)
 			return s.exitTextBlock()
 		case isEndOfFile(r):
-			s.errorf("end of file while processing command")
+			return s.errorf("end of file while processing command")
 		default:
-			s.errorf("invalid character '%q' in command", r)
+			return s.errorf("invalid character '%q' in command", r)
 		}
 	}
 }
@@ -913,9 +1147,11 @@ func scanFullCmd(s *scanner) ƒ {
 			cobra.Tag("scan").LogV("scan cmd context")
 			s.cmdDepth += 1
 			s.emit(tokenLeftSquare)
+			s.contexts = append(s.contexts, cmdContext{file: s.scanFile, blank: -1})
 		case r == ']':
 			s.emit(tokenRightSquare)
 			s.cmdDepth -= 1
+			s.popContext()
 			cobra.Tag("scan").Add("line", s.line).LogV("done scanning extended command")
 			s.inMacroDef = false
 
@@ -933,22 +1169,78 @@ func scanFullCmd(s *scanner) ƒ {
 		case r == '}':
 			s.emit(tokenRightCurly)
 			return s.exitTextBlock()
-		case s.isComment(r):
-			// s.backup()
+		case s.isComment():
+			if s.atBlockComment() {
+				if !s.skipBlockComment() {
+					return s.resumeContext()
+				}
+				continue
+			}
 			s.emit(tokenComment)
-			// scanCommentToggle(s)
 		case isEndOfLine(r):
+			if n := len(s.contexts); r == '\n' && n > 0 && s.contexts[n-1].blank < 0 && s.atBlankLine() {
+				s.contexts[n-1].blank, s.contexts[n-1].line = s.pos-s.width, s.line-1
+			}
 			s.emit(tokenLineBreak)
 		case isHSpace(r):
 			s.eatSpaces()
 		case isEndOfFile(r):
-			s.errorf("end of file while processing command")
+			return s.contextErrorf("end of file while processing command")
 		default:
-			s.errorf("invalid character %q in command body", r)
+			return s.contextErrorf("invalid character %q in command body", r)
 		}
 	}
 }
 
+// popContext removes the innermost command context.
+func (s *scanner) popContext() (c cmdContext) {
+	c.blank = -1
+	if n := len(s.contexts); n > 0 {
+		c = s.contexts[n-1]
+		s.contexts = s.contexts[:n-1]
+	}
+	return
+}
+
+// skipContext skips the rest of the command context in which an error was
+// found so that the scan can continue. The context ends at its closing ] or
+// at a blank line. If the context already ran past a blank line, its ] is
+// probably missing, so the scan resumes at that blank line instead.
+func skipContext(s *scanner) ƒ {
+	c := s.popContext()
+	if c.file == s.scanFile && c.blank >= 0 {
+		s.pos, s.line = c.blank, c.line
+	} else {
+	Loop:
+		for depth := 1; depth > 0; {
+			switch r := s.next(); {
+			case r == '[', r == '{':
+				depth++
+			case r == ']', r == '}':
+				depth--
+			case r == '\n' && s.atBlankLine():
+				s.backup()
+				break Loop
+			case isEndOfFile(r):
+				break Loop
+			}
+		}
+	}
+
+	s.forget()
+	s.cmdDepth -= 1
+	s.inMacroDef = false
+	cobra.Tag("scan").Add("line", s.line).LogV("skipped command context after an error")
+	return scanText
+}
+
+// atBlankLine returns true if the line that begins at the current position
+// holds nothing but spaces.
+func (s *scanner) atBlankLine() bool {
+	rest := strings.TrimLeft(s.input[s.pos:], hSpaceChars)
+	return rest == "" || isEndOfLine(rune(rest[0]))
+}
+
 func scanCmdFlags(s *scanner) {
 	for {
 		switch r := s.next(); {
@@ -960,7 +1252,7 @@ func scanCmdFlags(s *scanner) {
 			s.emit(tokenTilde)
 		case isHSpace(r):
 			s.eatSpaces()
-		case r == '>':
+		case r == '>', isEndOfFile(r):
 			s.backup()
 			return
 		default:
@@ -975,7 +1267,7 @@ func scanFileName(s *scanner) string {
 		switch r := s.next(); {
 		// case isAlphaNumeric(r) || r == '_' || r == '.' || r == '-' || r == '*':
 		// 	continue
-		case s.isComment(r):
+		case s.isComment():
 			s.emit(tokenComment)
 		case r == ')':
 			s.backup()
@@ -984,7 +1276,31 @@ func scanFileName(s *scanner) string {
 			cobra.Tag("scan").Add("line", s.line).WithField("name", name).LogfV("read file name")
 			return name
 		case isEndOfFile(r):
-			s.errorf("encountered end of file while reading file name")
+			s.backup()
+			return ""
+		}
+	}
+}
+
+// scanImportCondition reads the condition of a conditional import such as
+// •&[format=html](file). It returns false if the condition isn't closed.
+func scanImportCondition(s *scanner) (string, bool) {
+	// input: •&[...](file)
+	// s.pos:   ^
+	s.next()
+	s.ignore()
+
+	for {
+		switch r := s.next(); {
+		case r == ']':
+			s.backup()
+			cond := strings.TrimSpace(s.input[s.start:s.pos])
+			s.next()
+			s.ignore()
+			return cond, true
+		case isEndOfLine(r), isEndOfFile(r):
+			s.errorf("import condition is not closed")
+			return "", false
 		}
 	}
 }
@@ -994,9 +1310,8 @@ func scanName(s *scanner) string {
 		switch r := s.next(); {
 		case isAlphaNumeric(r) || r == '_' || r == '.' || r == '-' || r == '*':
 			continue
-		case s.isComment(r):
+		case s.isComment():
 			s.emit(tokenComment)
-			// scanCommentToggle(s)
 		default:
 			var name string
 			alt := false
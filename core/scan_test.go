@@ -610,6 +610,65 @@ var commonTestCases = []testCase{
 		tRightSquare,
 		tEOF}),
 
+	// block comment Tests
+	newCase("block comment", "1◊[2 •3{4}]◊5", tokenList{
+		tText,
+		tText,
+		tEOF}),
+	newCase("nested block comment", "1◊[2◊[3]◊4]◊5", tokenList{
+		tText,
+		tText,
+		tEOF}),
+	newCase("block comment hides import", "1◊[•&(missing.st)]◊2", tokenList{
+		tText,
+		tText,
+		tEOF}),
+	newCase("block comment in command list", "•1[2={3}◊[{4}]◊]", tokenList{
+		tCmdStart,
+		tName,
+		tLeftSquare,
+		tName,
+		tEqual,
+		tLeftCurly,
+		tText,
+		tRightCurly,
+		tRightSquare,
+		tEOF}),
+	newCase("unterminated block comment", "1◊[2◊[3]◊4", tokenList{
+		tText,
+		tError}),
+	newCase("line comment beginning with [", "1◊[2\n3", tokenList{
+		tText,
+		tComment,
+		tText,
+		tLineBreak,
+		tText,
+		tEOF}),
+
+	// verbatim Tests
+	newCase("verbatim block", "1•`2•3{4}◊5`•6", tokenList{
+		tText,
+		tText,
+		tText,
+		tEOF}),
+	newCase("verbatim block with backticks", "1•``2`•3``•4", tokenList{
+		tText,
+		tText,
+		tText,
+		tEOF}),
+	newCase("verbatim block in command body", "•1{2•`}{`•3}", tokenList{
+		tCmdStart,
+		tName,
+		tLeftCurly,
+		tText,
+		tText,
+		tText,
+		tRightCurly,
+		tEOF}),
+	newCase("unterminated verbatim block", "1•`2`", tokenList{
+		tText,
+		tError}),
+
 	// sysCmd Tests
 	newCase("bare system commands", "1•(a)2", tokenList{
 		tText,
@@ -1300,3 +1359,45 @@ func printTokenCodes() {
 		}
 	}
 }
+
+// Benchmarks -----------------------------------------------------------------
+
+// benchInput returns n paragraphs that exercise the common token types.
+func benchInput(n int) string {
+	par := "Some text with •echo{a •echo{nested} command} and\n" +
+		"•echo[{a full command}] on two lines. ◊ a comment\n\n"
+	return strings.Repeat(par, n)
+}
+
+func BenchmarkScan(b *testing.B) {
+	d := &Document{Name: "bench", Text: benchInput(500)}
+	b.SetBytes(int64(len(d.Text)))
+	for i := 0; i < b.N; i++ {
+		s := scan(d)
+		for s.nextToken().typeof != tokenEOF {
+		}
+	}
+}
+
+func BenchmarkScanMacro(b *testing.B) {
+	d := &Document{Name: "bench"}
+	for i := 0; i < b.N; i++ {
+		s := scanMacro("echo", "<•echo{x}>", d, 1, DefaultSigils)
+		for s.nextToken().typeof != tokenEOF {
+		}
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	text := benchInput(100)
+	b.SetBytes(int64(len(text)))
+	for i := 0; i < b.N; i++ {
+		f := NewFolio()
+		d := NewDoc("bench", "bench.st")
+		d.Text = text
+		f.AppendDoc(d)
+		if _, err := f.MakeDocs(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
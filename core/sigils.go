@@ -0,0 +1,138 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Sigils are the strings that introduce commands, comments, and paragraph
+// controls. A sigil may be longer than one character, such as `\\` or `@@`.
+// An empty field means the default is used.
+type Sigils struct {
+	Cmd     string // Starts a horizontal-mode command, • by default
+	VCmd    string // Starts a vertical-mode command, § by default
+	Comment string // Starts a comment, ◊ by default
+	Par     string // Starts a paragraph control such as ¶+, ¶ by default
+}
+
+// DefaultSigils are used when no others are chosen.
+var DefaultSigils = Sigils{
+	Cmd:     "•",
+	VCmd:    "§",
+	Comment: "◊",
+	Par:     "¶",
+}
+
+// merge returns the sigils with the non-empty fields of o replacing those in
+// s.
+func (s Sigils) merge(o Sigils) Sigils {
+	if o.Cmd != "" {
+		s.Cmd = o.Cmd
+	}
+	if o.VCmd != "" {
+		s.VCmd = o.VCmd
+	}
+	if o.Comment != "" {
+		s.Comment = o.Comment
+	}
+	if o.Par != "" {
+		s.Par = o.Par
+	}
+	return s
+}
+
+// resolve returns the sigils with the defaults filling in empty fields.
+func (s Sigils) resolve() Sigils {
+	return DefaultSigils.merge(s)
+}
+
+// set assigns the named sigil, where name is one of cmd, vcmd, comment, or
+// par.
+func (s *Sigils) set(name, val string) error {
+	switch strings.ToLower(name) {
+	case "cmd":
+		s.Cmd = val
+	case "vcmd":
+		s.VCmd = val
+	case "comment":
+		s.Comment = val
+	case "par":
+		s.Par = val
+	default:
+		return fmt.Errorf("unknown sigil %q", name)
+	}
+	return nil
+}
+
+// Validate returns an error if the sigils can't be told apart from each
+// other or from the text and punctuation around them. Empty fields are
+// allowed since they are replaced by the defaults.
+func (s Sigils) Validate() error {
+	r := s.resolve()
+	named := []struct{ name, val string }{
+		{"cmd", r.Cmd},
+		{"vcmd", r.VCmd},
+		{"comment", r.Comment},
+		{"par", r.Par},
+	}
+
+	for i, a := range named {
+		first, _ := utf8.DecodeRuneInString(a.val)
+		switch {
+		case strings.IndexFunc(a.val, unicode.IsSpace) >= 0:
+			return fmt.Errorf("%s sigil %q contains a space", a.name, a.val)
+		case unicode.IsLetter(first), unicode.IsDigit(first), first == '_':
+			return fmt.Errorf("%s sigil %q begins with a letter or digit", a.name, a.val)
+		case strings.ContainsRune("{}[]()<>`*%'\"=,", first):
+			return fmt.Errorf("%s sigil %q begins with command punctuation", a.name, a.val)
+		}
+
+		for _, b := range named[i+1:] {
+			if strings.HasPrefix(a.val, b.val) || strings.HasPrefix(b.val, a.val) {
+				return fmt.Errorf("%s sigil %q and %s sigil %q overlap", a.name, a.val, b.name, b.val)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readSigils reads the sigils from a front matter value such as
+//
+//	sigils:
+//	  cmd: "@@"
+//	  comment: "//"
+func readSigils(v interface{}) (s Sigils, err error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return s, fmt.Errorf("sigils must be a map, not %T", v)
+	}
+
+	for k, val := range m {
+		str, ok := val.(string)
+		if !ok {
+			return s, fmt.Errorf("sigil %q must be a string, not %T", k, val)
+		}
+		if err = s.set(fmt.Sprint(k), str); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func renderWithSigils(t *testing.T, sigils Sigils, text string) string {
+	e, err := NewEngine(Options{Plain: true, Sigils: sigils})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out := new(strings.Builder)
+	if err = e.Render("test", strings.NewReader(text), out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return out.String()
+}
+
+func TestSigilsMultiChar(t *testing.T) {
+	sigils := Sigils{Cmd: "@@", Comment: "//"}
+	text := "a @@echo{b} • c // hidden\nd @@echo[{e}]"
+
+	exp := "a b • c d e"
+	if out := renderWithSigils(t, sigils, text); out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestSigilsParControl(t *testing.T) {
+	d := &Document{Name: "test", Text: "a ¶+b !!-c", Sigils: Sigils{Par: "!!"}}
+	s := scan(d)
+
+	var types []tokenType
+	for tk := s.nextToken(); tk.typeof != tokenEOF; tk = s.nextToken() {
+		types = append(types, tk.typeof)
+	}
+
+	exp := []tokenType{tokenText, tokenParScanOff, tokenText}
+	if len(types) != len(exp) {
+		t.Fatalf("expected %d tokens, got %d", len(exp), len(types))
+	}
+	for i := range exp {
+		if types[i] != exp[i] {
+			t.Errorf("token %d: expected %s, got %s", i, tokenTypeLookup(exp[i]), tokenTypeLookup(types[i]))
+		}
+	}
+}
+
+func TestSigilsBackslash(t *testing.T) {
+	text := `a \\echo{b} \\(newmacro*){
+    name: x
+    template: '<\\echo{[[.y]]}>'
+    parameters: [y]
+*}\\x{c}`
+
+	exp := "a b <c>"
+	if out := renderWithSigils(t, Sigils{Cmd: `\\`}, text); out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestSigilsFrontMatter(t *testing.T) {
+	text := ">>>\nsigils:\n  cmd: \"@@\"\n---\n@@echo{a} •echo{b}"
+
+	exp := "a •echo{b}"
+	if out := renderWithSigils(t, Sigils{}, text); out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestSigilsPackagesKeepDefaults(t *testing.T) {
+	f := NewFolio()
+	f.Sigils = Sigils{Cmd: "@@"}
+	f.AddMacro(NewMacro("wrap", "[•echo{[[.text]]}]", []string{"text"}, nil))
+
+	d := NewDoc("test", "test.st")
+	d.Text = "@@wrap{a}"
+	d.Plain = true
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if exp := "[a]"; out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestSigilsValidate(t *testing.T) {
+	bad := []Sigils{
+		{Cmd: "x"},
+		{Cmd: "@ @"},
+		{Cmd: "{"},
+		{Cmd: "@", Comment: "@@"},
+		{Par: "•"},
+	}
+
+	for _, s := range bad {
+		if err := s.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+
+	if err := (Sigils{Cmd: `\\`, Comment: "//"}).Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -23,32 +23,96 @@ import (
 	"text/template"
 )
 
+// funcMap holds the template functions available to every Folio. It must not
+// be modified; each Folio copies it and adds its own functions in NewFolio.
+// The functions whose result depends on the text of their arguments are
+// wrapped by refSafe, and len replaces the builtin for the same reason.
 var funcMap = template.FuncMap{
-	"title": strings.Title,
-	// getdata is added by NewFolio() in doc.go
-	// setdata is added by NewFolio() in doc.go
+	"title": refSafe("title", strings.Title),
+	// getdata, setdata and indata are added by NewFolio() in doc.go. The
+	// counter functions take the document, as in stepcounter .Doc "figure".
 	"add":        add,
 	"sub":        sub,
 	"mul":        mul,
 	"div":        div,
 	"strlist":    strlist,
 	"join":       join,
-	"split":      split,
-	"in":         in,
-	"contains":   contains,
+	"split":      refSafe("split", split),
+	"in":         refSafe("in", in),
+	"contains":   refSafe("contains", contains),
 	"addsuffix":  addsuffix,
 	"addprefix":  addprefix,
-	"replaceall": replaceall,
+	"replaceall": refSafe("replaceall", replaceall),
 	"trimspace":  trimspace,
-	"lower":      lower,
-	"upper":      upper,
+	"lower":      refSafe("lower", lower),
+	"upper":      refSafe("upper", upper),
+	"len":        refSafe("len", length),
+
+	"newcounter":   (*Document).DefineCounter,
+	"stepcounter":  (*Document).StepCounter,
+	"resetcounter": (*Document).ResetCounter,
+	"counter":      (*Document).Counter,
+	"countervalue": (*Document).CounterValue,
 }
 
-func DumpData(key string) interface{} {
+// newFuncMap returns a copy of funcMap extended with the functions that
+// access the Folio's data.
+func (f *Folio) newFuncMap() template.FuncMap {
+	fm := make(template.FuncMap, len(funcMap)+3)
+	for k, v := range funcMap {
+		fm[k] = v
+	}
+	fm["setdata"] = f.SetData
+	fm["getdata"] = f.GetData
+	fm["indata"] = f.InData
+	return fm
+}
+
+// refSafe wraps the template function fn so that it fails if one of its
+// arguments holds a ref placeholder. A ref's value isn't known until the
+// Folio has been rendered, so fn would otherwise work on the placeholder's
+// text and quietly give the wrong result.
+func refSafe(name string, fn interface{}) interface{} {
+	fv := reflect.ValueOf(fn)
+	return reflect.MakeFunc(fv.Type(), func(args []reflect.Value) []reflect.Value {
+		for _, a := range args {
+			if hasRef(a) {
+				// The template package reports the panic as the function's error.
+				panic(fmt.Errorf("%s can't be given a ref because refs are resolved after the macro is rendered", name))
+			}
+		}
+		if fv.Type().IsVariadic() {
+			return fv.CallSlice(args)
+		}
+		return fv.Call(args)
+	}).Interface()
+}
+
+// hasRef returns true if v is, or holds, a string containing a ref
+// placeholder.
+func hasRef(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.Contains(v.String(), refOpen)
+	case reflect.Interface, reflect.Ptr:
+		return !v.IsNil() && hasRef(v.Elem())
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if hasRef(v.Index(i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *Folio) DumpData(key string) interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	vals := []interface{}{}
-	val, found := Data[key]
+	val, found := f.Data[key]
 	if !found {
-		for k, v := range Data {
+		for k, v := range f.Data {
 			if strings.HasPrefix(k, key) {
 				vals = append(vals, v)
 			}
@@ -71,11 +135,6 @@ func DumpData(key string) interface{} {
 	return strings.Join(s, " ")
 }
 
-func SetData(key string, val interface{}) string {
-	Data[key] = val
-	return ""
-}
-
 // add returns the sum of a and b.
 func add(a, b interface{}) (interface{}, error) {
 	av := reflect.ValueOf(a)
@@ -431,6 +490,16 @@ func trimspace(s string) (string, error) {
 	return strings.TrimSpace(s), nil
 }
 
+// length returns the length of v like the len builtin.
+func length(v interface{}) (int, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Chan, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len(), nil
+	}
+	return 0, fmt.Errorf("len of type %T", v)
+}
+
 func lower(s string) (string, error) {
 	return strings.ToLower(s), nil
 }
@@ -0,0 +1,223 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kevinkenan/cobra"
+)
+
+// A table of contents is rendered as a placeholder like a ref. Headings
+// register their entries as they are rendered, so the table can only be
+// built once every heading it lists has been seen. The placeholders are
+// expanded before the refs are resolved, so refs in the headings are
+// resolved too.
+const (
+	tocOpen  = "\uE002" // begins a table of contents placeholder
+	tocClose = "\uE003" // ends a table of contents placeholder
+)
+
+// TOCEntry is a heading listed in the tables of contents.
+type TOCEntry struct {
+	Level int    // The heading's level, 1 for the outermost headings
+	Title string // The rendered text of the heading
+	Label string // The anchor that links to the heading, if any
+	doc   *Document
+}
+
+// pendingTOC is a table of contents waiting to be expanded.
+type pendingTOC struct {
+	folio bool     // true if the table lists the headings of every document
+	depth int      // the deepest level listed, or 0 for every level
+	tok   *token   // the source token reported if the table can't be rendered
+	stack []string // the macro call stack where the table was written
+}
+
+// tocNode is an entry in a table of contents along with the entries nested
+// below it.
+type tocNode struct {
+	entry    TOCEntry
+	children []*tocNode
+}
+
+// AddTOCEntry registers a heading for the tables of contents. Heading macros
+// call it while they are rendered, either with the tocentry system command or
+// from a template with [[ .Doc.AddTOCEntry 1 .title .id ]].
+func (d *Document) AddTOCEntry(level int, title, label string) (string, error) {
+	if level < 1 {
+		return "", fmt.Errorf("toc entry %q has level %d, levels begin at 1", title, level)
+	}
+
+	d.tocEntries = append(d.tocEntries, TOCEntry{Level: level, Title: title, Label: label, doc: d})
+	cobra.Tag("toc").WithField("level", level).Strunc("title", title).Add("label", label).LogV("added toc entry")
+	return "", nil
+}
+
+// TOCEntries returns the headings the document registered while it was
+// rendered.
+func (d *Document) TOCEntries() []TOCEntry {
+	return d.tocEntries
+}
+
+// HasFolioTOC returns true if the document has a table of contents listing
+// the headings of every document in the Folio.
+func (d *Document) HasFolioTOC() bool {
+	for _, toc := range d.tocs {
+		if toc.folio {
+			return true
+		}
+	}
+	return false
+}
+
+// processTOCCmd handles the system commands that register headings and place
+// tables of contents.
+func (r *Render) processTOCCmd(n *Cmd) (items []RenderItem) {
+	name := n.GetCmdName()
+	m := r.getMacro(name, "")
+	if m == nil {
+		r.errorf(n, "system command %q not defined", name)
+	}
+
+	args, err := m.ValidateArgs(n, r.Doc)
+	if err != nil {
+		r.fail(n, err)
+	}
+
+	switch name {
+	case "sys.tocentry":
+		level, err := strconv.Atoi(strings.TrimSpace(args["level"].String()))
+		if err != nil {
+			r.errorf(n, "toc entry level %q isn't a number", args["level"].String())
+		}
+		title := r.ConvertRenderItems(r.renderNodeList(args["title"]))
+		if _, err = r.Doc.AddTOCEntry(level, title, strings.TrimSpace(args["label"].String())); err != nil {
+			r.fail(n, err)
+		}
+	case "sys.toc":
+		toc := pendingTOC{tok: r.callerToken(n), stack: append([]string{}, r.context...)}
+		switch scope := strings.TrimSpace(args["scope"].String()); scope {
+		case "document":
+		case "folio":
+			toc.folio = true
+		default:
+			r.errorf(n, "toc scope %q isn't document or folio", scope)
+		}
+		if toc.depth, err = strconv.Atoi(strings.TrimSpace(args["depth"].String())); err != nil || toc.depth < 0 {
+			r.errorf(n, "toc depth %q isn't a number of levels", args["depth"].String())
+		}
+
+		r.Doc.tocs = append(r.Doc.tocs, toc)
+		ri := r.MakeRenderItem(refItem, tocOpen+strconv.Itoa(len(r.Doc.tocs)-1)+tocClose)
+		ri.cmd = n
+		items = append(items, ri)
+	}
+	return
+}
+
+// expandTOCs replaces the table of contents placeholders in s with the
+// tables rendered by the toc.list and toc.item macros.
+func (d *Document) expandTOCs(s string) (string, error) {
+	if len(d.tocs) == 0 {
+		return s, nil
+	}
+
+	var err error
+	s = replacePlaceholders(s, tocOpen, tocClose, len(d.tocs), func(n int) string {
+		out, terr := d.renderTOC(&d.tocs[n])
+		err = joinDiagnostics(err, terr)
+		return out
+	})
+	cobra.Tag("render").WithField("tocs", len(d.tocs)).LogV("expanded tables of contents")
+	return s, err
+}
+
+// renderTOC renders the entries of the table of contents as nested lists.
+func (d *Document) renderTOC(toc *pendingTOC) (s string, err error) {
+	entries := d.tocEntries
+	if toc.folio {
+		entries = nil
+		for _, doc := range d.Folio.GetDocs() {
+			if len(doc.tocEntries) > 0 {
+				d.addRefSource(doc)
+			}
+			entries = append(entries, doc.tocEntries...)
+		}
+	}
+
+	return d.renderDeferred(toc.tok, toc.stack, func(r *Render, t *token) string {
+		return r.renderTOCList(nestTOC(entries, toc.depth), 1, t)
+	})
+}
+
+// nestTOC places each entry below the closest preceding entry with a lower
+// level. Entries deeper than depth are left out unless depth is 0.
+func nestTOC(entries []TOCEntry, depth int) []*tocNode {
+	root := &tocNode{}
+	stack := []*tocNode{root}
+
+	for _, e := range entries {
+		if depth > 0 && e.Level > depth {
+			continue
+		}
+		for len(stack) > 1 && stack[len(stack)-1].entry.Level >= e.Level {
+			stack = stack[:len(stack)-1]
+		}
+		n := &tocNode{entry: e}
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, n)
+		stack = append(stack, n)
+	}
+
+	return root.children
+}
+
+// renderTOCList renders the nodes as a list at the given nesting level.
+func (r *Render) renderTOCList(nodes []*tocNode, level int, t *token) string {
+	items := strings.Builder{}
+	for _, n := range nodes {
+		children := ""
+		if len(n.children) > 0 {
+			children = r.renderTOCList(n.children, level+1, t)
+		}
+
+		e := n.entry
+		title := e.Title
+		if e.doc != r.Doc {
+			// Refs in the titles of other documents are numbered by those
+			// documents.
+			title = replacePlaceholders(title, refOpen, refClose, len(e.doc.refs), func(i int) string {
+				val, _ := r.Doc.refValue(&e.doc.refs[i])
+				return val
+			})
+		}
+
+		items.WriteString(r.renderGenerated("toc.item", t, map[string]string{
+			"level":    strconv.Itoa(level),
+			"title":    title,
+			"label":    e.Label,
+			"link":     r.Doc.linkTo(e.doc, e.Label),
+			"children": children,
+		}))
+	}
+
+	return r.renderGenerated("toc.list", t, map[string]string{
+		"level": strconv.Itoa(level),
+		"items": items.String(),
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const tocMacros = `•(newmacro)[def*={
+    name: sec
+    parameters: [level, text, id]
+    template: '•(tocentry)[level={[[ .level ]]} title={[[ .text ]]} label={[[ .id ]]}][[ .text ]]'
+}*}]
+•(newmacro)[def*={
+    name: sub
+    parameters: [text]
+    template: '[[ .Doc.AddTOCEntry 2 .text "" ]][[ .text ]]'
+}*}]
+•(newmacro)[def*={
+    name: toc.list
+    parameters: [items]
+    template: '([[ .items ]])'
+}*}]
+•(newmacro)[def*={
+    name: toc.item
+    parameters: [title, link, children]
+    template: '[[ .title ]]=[[ .link ]][[ .children ]];'
+}*}]`
+
+func TestTOC(t *testing.T) {
+	f := NewFolio()
+	if err := f.loadMacros("macrodef", "", tocMacros); err != nil {
+		t.Fatalf("loadMacros: unexpected error: %s", err)
+	}
+
+	d := NewDoc("testname", "testpath")
+	d.Text = "see •(toc)\n•sec[{1}{A}{a}]\n•sec[{2}{B}{b}]\n•sub{C}\n•sec[{1}{D}{d}]"
+	d.Plain = true
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "see (A=#a(B=#b;C=#;);D=#d;)\nA\nB\nC\nD"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
+
+func TestFolioTOC(t *testing.T) {
+	f := NewFolio()
+	if err := f.loadMacros("macrodef", "", tocMacros); err != nil {
+		t.Fatalf("loadMacros: unexpected error: %s", err)
+	}
+
+	d1 := NewDoc("a.st", "src/a.st")
+	d1.Text = "see •(toc)[scope={folio} depth={1}]"
+	d1.OutputPath = "index.html"
+	d2 := NewDoc("b.st", "src/b.st")
+	d2.Text = "•sec[{1}{One}{one}]\n•sec[{2}{Sub}{sub}]"
+	d2.OutputPath = "ch/one.html"
+	d3 := NewDoc("c.st", "src/c.st")
+	d3.Text = "•sec[{1}{Part •(ref){n}}{two}]\n•(refdef)[label={n} ref={2}]"
+	d3.OutputPath = "ch/two.html"
+	for _, d := range []*Document{d1, d2, d3} {
+		d.Plain = true
+		f.AppendDoc(d)
+	}
+
+	if err := f.FirstPass(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.HasFolioTOC() {
+		t.Errorf("the first pass didn't find the folio toc")
+	}
+
+	for _, d := range f.GetDocs() {
+		if _, err := d.MakeDeferred(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	out, err := d1.ResolveRefs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "see (One=ch/one.html#one;Part 2=ch/two.html#two;)"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+
+	refs := []string{"src/b.st", "src/c.st"}
+	if fmt.Sprint(d1.Refs) != fmt.Sprint(refs) {
+		t.Errorf("expected refs %v, got %v", refs, d1.Refs)
+	}
+}
+
+func TestTOCErrors(t *testing.T) {
+	tests := []struct {
+		text, exp string
+	}{
+		{"•(toc)[scope={site}]", `toc scope "site" isn't document or folio`},
+		{"•(toc)[depth={deep}]", `toc depth "deep" isn't a number of levels`},
+		{"•(tocentry)[{x}{A}]", `toc entry level "x" isn't a number`},
+		{"•(tocentry)[{0}{A}]", `toc entry "A" has level 0, levels begin at 1`},
+	}
+
+	for _, tc := range tests {
+		f := NewFolio()
+		d := NewDoc("testname", "testpath")
+		d.Text = tc.text
+		d.Plain = true
+		f.AppendDoc(d)
+
+		_, err := f.MakeDocs()
+		if err == nil || !strings.Contains(err.Error(), tc.exp) {
+			t.Errorf("%q\nExpected: %s\n     Got: %v", tc.text, tc.exp, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Position is the location of a node in a source file.
+type Position struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`   // starting at 1
+	Column int    `json:"column"` // in runes, starting at 1
+}
+
+func (p *Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// tokenPosition returns the position of the token, or nil if the token
+// isn't from a source file.
+func tokenPosition(t *token) *Position {
+	d := &Diagnostic{}
+	d.locate(t)
+	if !d.located {
+		return nil
+	}
+	return &Position{d.File, d.Line, d.Column}
+}
+
+// TreeNode describes a node of a parse tree for tools that inspect documents.
+// Text generated by macros has no position.
+type TreeNode struct {
+	Type     string                 `json:"type"`            // document, section, text, cmd, or error
+	Name     string                 `json:"name,omitempty"`  // the document or command name
+	Value    string                 `json:"value,omitempty"` // the text, the document path, or the error message
+	Pos      *Position              `json:"pos,omitempty"`
+	Flags    []string               `json:"flags,omitempty"`
+	SysCmd   bool                   `json:"syscmd,omitempty"`
+	Block    bool                   `json:"block,omitempty"`
+	Series   bool                   `json:"series,omitempty"`
+	Args     [][]*TreeNode          `json:"args,omitempty"`     // positional arguments
+	Named    map[string][]*TreeNode `json:"named,omitempty"`    // named arguments
+	Children []*TreeNode            `json:"children,omitempty"` // the contents of a document or section
+}
+
+// NewDocTree describes the document and the parse tree in root.
+func NewDocTree(d *Document, root *Section) *TreeNode {
+	t := &TreeNode{Type: "document", Name: d.Name, Value: d.Path}
+	if root != nil {
+		t.Children = newTreeList(root.NodeList)
+	}
+	return t
+}
+
+// NewTree describes the parse tree below n.
+func NewTree(n Node) *TreeNode {
+	switch n := n.(type) {
+	case *Section:
+		return &TreeNode{Type: "section", Children: newTreeList(n.NodeList)}
+	case *Text:
+		return &TreeNode{Type: "text", Value: n.GetText(), Pos: tokenPosition(n.textToken)}
+	case *ErrorNode:
+		t := &TreeNode{Type: "error", Value: n.GetErrorMsg()}
+		if n.diag != nil && n.diag.located {
+			t.Pos = &Position{n.diag.File, n.diag.Line, n.diag.Column}
+		}
+		return t
+	case *SysCmd:
+		return &TreeNode{Type: "cmd", Name: n.GetText(), SysCmd: true}
+	case *Cmd:
+		t := &TreeNode{
+			Type:   "cmd",
+			Name:   n.GetCmdName(),
+			Pos:    tokenPosition(n.cmdToken),
+			Flags:  n.Flags,
+			SysCmd: n.SysCmd,
+			Block:  n.Block,
+			Series: n.Series,
+		}
+		if n.Anonymous {
+			for _, nl := range n.ArgList {
+				t.Args = append(t.Args, newTreeList(nl))
+			}
+		} else if len(n.ArgMap) > 0 {
+			t.Named = make(map[string][]*TreeNode, len(n.ArgMap))
+			for k, nl := range n.ArgMap {
+				t.Named[k] = newTreeList(nl)
+			}
+		}
+		return t
+	}
+	return &TreeNode{Type: fmt.Sprintf("unknown(%d)", n.Typeof()), Value: n.String()}
+}
+
+func newTreeList(nl NodeList) []*TreeNode {
+	l := make([]*TreeNode, 0, len(nl))
+	for _, n := range nl {
+		l = append(l, NewTree(n))
+	}
+	return l
+}
+
+// Tree returns the tree as an indented outline with one node per line.
+func (t *TreeNode) Tree() string {
+	b := new(strings.Builder)
+	t.writeTree(b, "")
+	return b.String()
+}
+
+func (t *TreeNode) writeTree(b *strings.Builder, indent string) {
+	b.WriteString(indent)
+	b.WriteString(t.Type)
+	if t.Name != "" {
+		b.WriteString(" " + t.Name)
+	}
+	if t.Value != "" {
+		b.WriteString(" " + strconv.Quote(t.Value))
+	}
+	if len(t.Flags) > 0 {
+		b.WriteString(" <" + strings.Join(t.Flags, ",") + ">")
+	}
+	for _, attr := range t.attrs() {
+		b.WriteString(" " + attr)
+	}
+	if t.Pos != nil {
+		b.WriteString(" @" + t.Pos.String())
+	}
+	b.WriteString("\n")
+
+	inner := indent + "  "
+	for _, c := range t.Children {
+		c.writeTree(b, inner)
+	}
+	for i, arg := range t.Args {
+		fmt.Fprintf(b, "%sarg %d\n", inner, i+1)
+		for _, c := range arg {
+			c.writeTree(b, inner+"  ")
+		}
+	}
+	for _, k := range t.namedKeys() {
+		fmt.Fprintf(b, "%sarg %s\n", inner, k)
+		for _, c := range t.Named[k] {
+			c.writeTree(b, inner+"  ")
+		}
+	}
+}
+
+// SExpr returns the tree as an s-expression such as
+//
+//	(cmd "echo" :pos "doc.st:1:3" (arg 1 (text "hello")))
+func (t *TreeNode) SExpr() string {
+	b := new(strings.Builder)
+	t.writeSExpr(b)
+	b.WriteString("\n")
+	return b.String()
+}
+
+func (t *TreeNode) writeSExpr(b *strings.Builder) {
+	b.WriteString("(" + t.Type)
+	if t.Name != "" {
+		b.WriteString(" " + strconv.Quote(t.Name))
+	}
+	if t.Value != "" {
+		b.WriteString(" " + strconv.Quote(t.Value))
+	}
+	if t.Pos != nil {
+		b.WriteString(" :pos " + strconv.Quote(t.Pos.String()))
+	}
+	if len(t.Flags) > 0 {
+		b.WriteString(" :flags (")
+		for i, f := range t.Flags {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(strconv.Quote(f))
+		}
+		b.WriteString(")")
+	}
+	for _, attr := range t.attrs() {
+		b.WriteString(" :" + attr)
+	}
+	for _, c := range t.Children {
+		b.WriteString(" ")
+		c.writeSExpr(b)
+	}
+	for i, arg := range t.Args {
+		fmt.Fprintf(b, " (arg %d", i+1)
+		for _, c := range arg {
+			b.WriteString(" ")
+			c.writeSExpr(b)
+		}
+		b.WriteString(")")
+	}
+	for _, k := range t.namedKeys() {
+		fmt.Fprintf(b, " (arg %s", strconv.Quote(k))
+		for _, c := range t.Named[k] {
+			b.WriteString(" ")
+			c.writeSExpr(b)
+		}
+		b.WriteString(")")
+	}
+	b.WriteString(")")
+}
+
+// attrs returns the names of the command attributes that are set.
+func (t *TreeNode) attrs() (attrs []string) {
+	if t.SysCmd {
+		attrs = append(attrs, "syscmd")
+	}
+	if t.Block {
+		attrs = append(attrs, "block")
+	}
+	if t.Series {
+		attrs = append(attrs, "series")
+	}
+	return
+}
+
+// namedKeys returns the names of the named arguments in sorted order.
+func (t *TreeNode) namedKeys() []string {
+	keys := make([]string, 0, len(t.Named))
+	for k := range t.Named {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func parseTree(t *testing.T, text string) *TreeNode {
+	f := NewFolio()
+	d := NewDoc("testname", "dir/test.st")
+	d.Text = text
+	f.AppendDoc(d)
+
+	root, err := Parse(d)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return NewDocTree(d, root)
+}
+
+func TestTreeOutline(t *testing.T) {
+	tree := parseTree(t, ">>>\nmode: plain\n---\na •echo[<x>{b}]\n•echo[text={c}]")
+
+	exp := `document testname "dir/test.st"
+  text "a " @dir/test.st:4:1
+  cmd echo <x> @dir/test.st:4:4
+    arg 1
+      text "b" @dir/test.st:4:13
+  text "\n" @dir/test.st:4:16
+  cmd echo @dir/test.st:5:2
+    arg text
+      text "c" @dir/test.st:5:13
+`
+	if tree.Tree() != exp {
+		t.Errorf("\nExpected:\n%s\n     Got:\n%s", exp, tree.Tree())
+	}
+}
+
+func TestTreeSExpr(t *testing.T) {
+	tree := parseTree(t, ">>>\nmode: plain\n---\n•echo{a}")
+
+	exp := `(document "testname" "dir/test.st" (cmd "echo" :pos "dir/test.st:4:2" (arg 1 (text "a" :pos "dir/test.st:4:7"))))` + "\n"
+	if tree.SExpr() != exp {
+		t.Errorf("\nExpected: %s\n     Got: %s", exp, tree.SExpr())
+	}
+}
+
+func TestTreeJSON(t *testing.T) {
+	tree := parseTree(t, ">>>\nmode: plain\n---\n•echo[text={a}]")
+
+	b, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var back TreeNode
+	if err = json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := back.Children[0]
+	if cmd.Type != "cmd" || cmd.Name != "echo" || cmd.Pos == nil || cmd.Pos.Line != 4 {
+		t.Errorf("unexpected command: %s", b)
+	}
+	if len(cmd.Named["text"]) != 1 || cmd.Named["text"][0].Value != "a" {
+		t.Errorf("unexpected arguments: %s", b)
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package lsp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kevinkenan/cobra"
+	"github.com/kevinkenan/subtext/core"
+)
+
+// document is an open document along with the Folio it was checked in.
+type document struct {
+	uri    string
+	path   string
+	text   string
+	folio  *core.Folio
+	doc    *core.Document
+	errors []error // the problems found while rendering the document
+}
+
+// check renders the text in a new Folio to find its problems and the macros
+// it can use. A package file is loaded the way packages are.
+func (s *Server) check(uri, text string) (*document, error) {
+	f, err := s.newFolio()
+	if err != nil {
+		return nil, err
+	}
+	f.KeepGoing = true
+
+	path := uriPath(uri)
+	name := filepath.Base(path)
+	d := &document{uri: uri, path: path, text: text, folio: f}
+	d.doc = core.NewDoc(name, path)
+	d.doc.Text = text
+
+	switch {
+	case filepath.Ext(path) == ".stm":
+		d.doc.Plain = true
+		err = f.LoadPackageText(name, path, text)
+	case text != "":
+		// An empty document would be read from the file instead.
+		if err = f.AppendDoc(d.doc); err == nil {
+			_, err = f.MakeDocs()
+		}
+	}
+
+	if err != nil {
+		d.errors = flattenErrors(err)
+	}
+	cobra.Tag("lsp").Add("uri", uri).Add("errors", len(d.errors)).LogV("checked document")
+	return d, nil
+}
+
+// flattenErrors returns the individual errors held by err.
+func flattenErrors(err error) []error {
+	if ds, ok := err.(core.Diagnostics); ok {
+		errs := make([]error, len(ds))
+		for i, d := range ds {
+			errs[i] = d
+		}
+		return errs
+	}
+	return []error{err}
+}
+
+// diagnostics converts the document's problems to LSP diagnostics. Problems
+// in other files, such as imports and packages, are reported at the start of
+// the document.
+func (d *document) diagnostics() []diagnostic {
+	diags := []diagnostic{}
+
+	for _, err := range d.errors {
+		diag := diagnostic{Severity: severityError, Source: "subtext", Message: err.Error()}
+
+		if cd, ok := err.(*core.Diagnostic); ok {
+			if cd.Severity == core.SeverityWarning {
+				diag.Severity = severityWarning
+			}
+			if cd.File == d.path && cd.Line > 0 {
+				p := runePosition(d.text, cd.Line, cd.Column)
+				diag.Range = lspRange{p, p}
+				diag.Message = cd.Message
+			}
+			for _, call := range cd.Stack {
+				diag.Message += "\n    in " + call
+			}
+		}
+
+		diags = append(diags, diag)
+	}
+
+	return diags
+}
+
+// completion lists the macros whose names begin with the name being typed
+// after a command sigil. After a sigil and (, it lists the system commands.
+func (s *Server) completion(d *document, offset int) (interface{}, error) {
+	list := &completionList{Items: []completionItem{}}
+
+	begin := offset
+	for begin > 0 {
+		r, w := utf8.DecodeLastRuneInString(d.text[:begin])
+		if !isNameRune(r) {
+			break
+		}
+		begin -= w
+	}
+	prefix := d.text[begin:offset]
+
+	before := d.text[:begin]
+	sys := strings.HasSuffix(before, "(")
+	if sys {
+		before = before[:len(before)-1]
+	}
+
+	sigils := d.sigils()
+	if !strings.HasSuffix(before, sigils.Cmd) && !strings.HasSuffix(before, sigils.VCmd) {
+		return list, nil
+	}
+
+	seen := map[string]bool{}
+	for _, m := range d.folio.MacroList() {
+		name := m.Name
+		if strings.HasPrefix(name, "sys.") != sys {
+			continue
+		}
+		name = strings.TrimPrefix(name, "sys.")
+		if seen[name] || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		seen[name] = true
+
+		m = d.macro(m.Name)
+		item := completionItem{Label: name, Kind: kindFunction, Detail: d.signature(m).Label}
+		if doc := d.describe(m, false); doc != "" {
+			item.Documentation = &markupContent{"markdown", doc}
+		}
+		list.Items = append(list.Items, item)
+	}
+
+	return list, nil
+}
+
+// signatureHelp shows the parameters of the command around the offset.
+func (s *Server) signatureHelp(d *document, offset int) (interface{}, error) {
+	ref := core.CmdAt(d.doc, offset)
+	if ref == nil {
+		return nil, nil
+	}
+
+	m := d.macro(ref.Name)
+	if m == nil {
+		return nil, nil
+	}
+
+	help := &signatureHelp{Signatures: []signatureInformation{d.signature(m)}}
+	params := d.params(m)
+	switch {
+	case ref.Arg != "":
+		for i, p := range params {
+			if p == ref.Arg {
+				help.ActiveParameter = i
+			}
+		}
+	case ref.ArgIndex > 0:
+		help.ActiveParameter = ref.ArgIndex
+		if help.ActiveParameter >= len(params) {
+			help.ActiveParameter = len(params) - 1
+		}
+	}
+
+	return help, nil
+}
+
+// definition finds where the macro named by the command at the offset was
+// defined with newmacro.
+func (s *Server) definition(d *document, offset int) (interface{}, error) {
+	ref := core.CmdAt(d.doc, offset)
+	if ref == nil || !ref.OnName {
+		return nil, nil
+	}
+
+	m := d.macro(ref.Name)
+	if m == nil || m.Pos == nil {
+		return nil, nil
+	}
+
+	path := m.Pos.File
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	text := ""
+	if path == d.path {
+		text = d.text
+	} else if b, err := ioutil.ReadFile(path); err == nil {
+		text = string(b)
+	}
+
+	p := runePosition(text, m.Pos.Line, m.Pos.Column)
+	return &location{URI: pathURI(path), Range: lspRange{p, p}}, nil
+}
+
+// hover describes the macro named by the command at the offset.
+func (s *Server) hover(d *document, offset int) (interface{}, error) {
+	ref := core.CmdAt(d.doc, offset)
+	if ref == nil || !ref.OnName {
+		return nil, nil
+	}
+
+	m := d.macro(ref.Name)
+	if m == nil {
+		return nil, nil
+	}
+
+	r := lspRange{positionOf(d.text, ref.Begin), positionOf(d.text, ref.End)}
+	return &hover{Contents: markupContent{"markdown", d.describe(m, true)}, Range: &r}, nil
+}
+
+// macro returns the named macro for the document's format, falling back to
+// the macro without a format and then to any format.
+func (d *document) macro(name string) *core.Macro {
+	var dflt, other *core.Macro
+	for _, m := range d.folio.MacroList() {
+		switch {
+		case m.Name != name:
+		case m.Format == d.doc.Format:
+			return m
+		case m.Format == "":
+			dflt = m
+		case other == nil:
+			other = m
+		}
+	}
+
+	if dflt != nil {
+		return dflt
+	}
+	return other
+}
+
+// params returns the names of the macro's parameters followed by those of
+// its optional parameters.
+func (d *document) params(m *core.Macro) []string {
+	params := append([]string{}, m.Parameters...)
+	for _, opt := range m.Optionals {
+		params = append(params, opt.Name)
+	}
+	return params
+}
+
+// signature shows how to call the macro, such as •link[url={} text={}].
+// Optional parameters show their defaults.
+func (d *document) signature(m *core.Macro) signatureInformation {
+	name := m.Name
+	sigil := d.sigils().Cmd
+	if strings.HasPrefix(name, "sys.") {
+		name = "(" + strings.TrimPrefix(name, "sys.") + ")"
+	}
+
+	var params []string
+	for _, p := range m.Parameters {
+		params = append(params, p+"={}")
+	}
+	for _, opt := range m.Optionals {
+		params = append(params, opt.Name+"={"+opt.Default+"}")
+	}
+
+	sig := signatureInformation{Label: sigil + name, Parameters: []parameterInformation{}}
+	if len(params) > 0 {
+		sig.Label += "[" + strings.Join(params, " ") + "]"
+	}
+	for _, p := range params {
+		sig.Parameters = append(sig.Parameters, parameterInformation{p})
+	}
+	return sig
+}
+
+// describe returns markdown describing the macro. The full description
+// starts with the signature.
+func (d *document) describe(m *core.Macro, full bool) string {
+	b := new(strings.Builder)
+	if full {
+		fmt.Fprintf(b, "```\n%s\n```\n", d.signature(m).Label)
+	}
+
+	var about []string
+	if m.Format != "" {
+		about = append(about, "format "+m.Format)
+	}
+	if m.Block {
+		about = append(about, "block")
+	}
+	switch {
+	case m.Func != nil || m.NodeFunc != nil:
+		about = append(about, "defined in Go")
+	case m.Pos != nil:
+		about = append(about, "defined at "+m.Pos.String())
+	}
+	if len(about) > 0 {
+		b.WriteString(strings.Join(about, ", ") + "\n")
+	}
+
+	if t := strings.TrimSpace(m.TemplateText); t != "" {
+		fmt.Fprintf(b, "\n```\n%s\n```\n", t)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// sigils returns the document's sigils with the defaults filled in.
+func (d *document) sigils() core.Sigils {
+	return resolveSigils(d.doc.Sigils)
+}
+
+// resolveSigils returns the sigils with the defaults filling in empty fields.
+func resolveSigils(s core.Sigils) core.Sigils {
+	if s.Cmd == "" {
+		s.Cmd = core.DefaultSigils.Cmd
+	}
+	if s.VCmd == "" {
+		s.VCmd = core.DefaultSigils.VCmd
+	}
+	if s.Comment == "" {
+		s.Comment = core.DefaultSigils.Comment
+	}
+	if s.Par == "" {
+		s.Par = core.DefaultSigils.Par
+	}
+	return s
+}
+
+// lastChar returns the last character of s, which clients use to trigger
+// completion.
+func lastChar(s string) string {
+	_, w := utf8.DecodeLastRuneInString(s)
+	return s[len(s)-w:]
+}
+
+// isNameRune returns true if r may appear in a macro name.
+func isNameRune(r rune) bool {
+	return r == '_' || r == '.' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// runePosition returns the LSP position of the line and column, both counted
+// from 1 with the column in runes, as reported by core.Diagnostic.
+func runePosition(text string, line, column int) position {
+	p := position{Line: line - 1}
+
+	offset := 0
+	for i := 1; i < line; i++ {
+		n := strings.IndexByte(text[offset:], '\n')
+		if n < 0 {
+			p.Character = column - 1
+			return p
+		}
+		offset += n + 1
+	}
+
+	for _, r := range text[offset:] {
+		if column <= 1 || r == '\n' {
+			break
+		}
+		column--
+		p.Character++
+		if r >= 0x10000 {
+			p.Character++
+		}
+	}
+	return p
+}
+
+// uriPath returns the file path of a file URI.
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// pathURI returns the file URI of a path.
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
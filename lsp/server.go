@@ -0,0 +1,232 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package lsp implements a Language Server Protocol server for subtext
+// documents (.st) and macro packages (.stm). The server speaks JSON-RPC over
+// a pair of streams, usually stdin and stdout. It reports the problems found
+// by the parser and renderer, completes macro names, shows the parameters of
+// the command being written, and finds and describes macro definitions.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/kevinkenan/cobra"
+	"github.com/kevinkenan/subtext/core"
+)
+
+// Server answers the requests of a single language client.
+type Server struct {
+	in       *bufio.Reader
+	out      io.Writer
+	newFolio func() (*core.Folio, error) // creates the Folio each document is checked in
+	docs     map[string]*document        // open documents by URI
+	shutdown bool                        // true once the client has asked the server to shut down
+}
+
+// NewServer creates a server that reads requests from in and writes responses
+// to out. Each document is checked in a new Folio from newFolio, which
+// should load the packages every document needs.
+func NewServer(in io.Reader, out io.Writer, newFolio func() (*core.Folio, error)) *Server {
+	return &Server{
+		in:       bufio.NewReader(in),
+		out:      out,
+		newFolio: newFolio,
+		docs:     make(map[string]*document),
+	}
+}
+
+// Serve handles messages until the client sends exit or closes the input.
+func (s *Server) Serve() error {
+	for {
+		m, err := readMessage(s.in)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			if rerr, ok := err.(*responseError); ok {
+				s.reply(nil, nil, rerr)
+				continue
+			}
+			return err
+		}
+
+		if m.Method == "exit" {
+			cobra.Tag("lsp").LogV("exit")
+			if !s.shutdown {
+				return fmt.Errorf("exit before shutdown")
+			}
+			return nil
+		}
+
+		result, err := s.handle(m)
+		if m.ID == nil {
+			if err != nil {
+				cobra.Tag("lsp").Add("method", m.Method).LogfV("notification failed: %s", err)
+			}
+			continue
+		}
+
+		rerr, ok := err.(*responseError)
+		if err != nil && !ok {
+			rerr = &responseError{codeInternalError, err.Error()}
+		}
+		if err = s.reply(m.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches the message and returns the result of a request.
+func (s *Server) handle(m *message) (interface{}, error) {
+	cobra.Tag("lsp").Add("method", m.Method).LogV("received message")
+
+	switch m.Method {
+	case "initialize":
+		return s.initialize()
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p didChangeParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			// The server asks for full text, so the last change holds it.
+			return nil, s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didSave":
+		return nil, nil
+	case "textDocument/didClose":
+		var p didCloseParams
+		if err := unmarshal(m.Params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{p.TextDocument.URI, []diagnostic{}})
+	case "textDocument/completion":
+		return s.withPosition(m, s.completion)
+	case "textDocument/signatureHelp":
+		return s.withPosition(m, s.signatureHelp)
+	case "textDocument/definition":
+		return s.withPosition(m, s.definition)
+	case "textDocument/hover":
+		return s.withPosition(m, s.hover)
+	}
+
+	if m.ID == nil {
+		return nil, nil
+	}
+	return nil, &responseError{codeMethodNotFound, fmt.Sprintf("method %q not supported", m.Method)}
+}
+
+// initialize describes what the server can do.
+func (s *Server) initialize() (interface{}, error) {
+	f, err := s.newFolio()
+	if err != nil {
+		return nil, err
+	}
+
+	sigils := resolveSigils(f.Sigils)
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync": 1, // the full text is sent with every change
+			"completionProvider": map[string]interface{}{
+				"triggerCharacters": []string{lastChar(sigils.Cmd), lastChar(sigils.VCmd), "("},
+			},
+			"signatureHelpProvider": map[string]interface{}{
+				"triggerCharacters": []string{"[", "{", "="},
+			},
+			"definitionProvider": true,
+			"hoverProvider":      true,
+		},
+		"serverInfo": map[string]string{"name": "subtext"},
+	}, nil
+}
+
+// update records the new text of the document and publishes its problems.
+func (s *Server) update(uri, text string) error {
+	d, err := s.check(uri, text)
+	if err != nil {
+		return err
+	}
+	s.docs[uri] = d
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{uri, d.diagnostics()})
+}
+
+// withPosition calls fn with the open document and the byte offset named by
+// the request's parameters.
+func (s *Server) withPosition(m *message, fn func(d *document, offset int) (interface{}, error)) (interface{}, error) {
+	var p positionParams
+	if err := unmarshal(m.Params, &p); err != nil {
+		return nil, err
+	}
+
+	d, found := s.docs[p.TextDocument.URI]
+	if !found {
+		return nil, &responseError{codeInvalidParams, fmt.Sprintf("document %q isn't open", p.TextDocument.URI)}
+	}
+
+	return fn(d, offsetOf(d.text, p.Position))
+}
+
+// reply sends the response to a request.
+func (s *Server) reply(id *json.RawMessage, result interface{}, rerr *responseError) error {
+	m := &message{ID: id}
+	if id == nil {
+		null := json.RawMessage("null")
+		m.ID = &null
+	}
+
+	if rerr != nil {
+		m.Error = rerr
+	} else {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		m.Result = b
+	}
+
+	return writeMessage(s.out, m)
+}
+
+// notify sends a notification to the client.
+func (s *Server) notify(method string, params interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &message{Method: method, Params: b})
+}
+
+func unmarshal(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &responseError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kevinkenan/cobra"
+	"github.com/kevinkenan/subtext/core"
+)
+
+func init() {
+	cfg := cobra.NewTestingConfig(nil)
+	cfg.LogPanicOnly()
+}
+
+const testPackage = `•(newmacro){
+    name: pair
+    parameters: [a, b]
+    optionals:
+        sep: "|"
+    template: "<[[.a]][[.sep]][[.b]]>"
+}
+`
+
+// client drives a Server through a pair of pipes the way an editor would.
+type client struct {
+	t    *testing.T
+	w    io.WriteCloser
+	r    *bufio.Reader
+	id   int
+	done chan error
+}
+
+func newClient(t *testing.T, pkgdir string) *client {
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+
+	s := NewServer(inr, outw, func() (*core.Folio, error) {
+		f := core.NewFolio()
+		f.PkgSearchPaths = []string{pkgdir}
+		return f, nil
+	})
+
+	c := &client{t: t, w: inw, r: bufio.NewReader(outr), done: make(chan error, 1)}
+	go func() {
+		err := s.Serve()
+		outw.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *client) send(m *message) {
+	if err := writeMessage(c.w, m); err != nil {
+		c.t.Fatalf("unable to send %s: %s", m.Method, err)
+	}
+}
+
+// notify sends a notification.
+func (c *client) notify(method string, params interface{}) {
+	b, _ := json.Marshal(params)
+	c.send(&message{Method: method, Params: b})
+}
+
+// call sends a request and decodes the result of the response into result.
+// Notifications that arrive first are skipped.
+func (c *client) call(method string, params interface{}, result interface{}) {
+	c.id++
+	id := json.RawMessage(strings.TrimSpace(string(mustMarshal(c.id))))
+	b, _ := json.Marshal(params)
+	c.send(&message{ID: &id, Method: method, Params: b})
+
+	for {
+		m := c.read()
+		if m.ID == nil {
+			continue
+		}
+		if m.Error != nil {
+			c.t.Fatalf("%s failed: %s", method, m.Error.Message)
+		}
+		if err := json.Unmarshal(m.Result, result); err != nil {
+			c.t.Fatalf("unable to decode the result of %s: %s", method, err)
+		}
+		return
+	}
+}
+
+// read returns the next message from the server.
+func (c *client) read() *message {
+	m, err := readMessage(c.r)
+	if err != nil {
+		c.t.Fatalf("unable to read from the server: %s", err)
+	}
+	return m
+}
+
+// diagnostics waits for the next published diagnostics.
+func (c *client) diagnostics() publishDiagnosticsParams {
+	for {
+		m := c.read()
+		if m.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var p publishDiagnosticsParams
+		if err := json.Unmarshal(m.Params, &p); err != nil {
+			c.t.Fatal(err)
+		}
+		return p
+	}
+}
+
+func (c *client) close() {
+	var result interface{}
+	c.call("shutdown", nil, &result)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Errorf("unexpected error from the server: %s", err)
+	}
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+func at(uri string, line, char int) positionParams {
+	return positionParams{textDocumentIdentifier{uri}, position{line, char}}
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subtext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgpath := filepath.Join(dir, "testpkg.stm")
+	if err = ioutil.WriteFile(pkgpath, []byte(testPackage), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t, dir)
+
+	var init map[string]interface{}
+	c.call("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}, &init)
+	if _, ok := init["capabilities"]; !ok {
+		t.Fatalf("initialize returned no capabilities: %v", init)
+	}
+	c.notify("initialized", struct{}{})
+
+	uri := pathURI(filepath.Join(dir, "doc.st"))
+	text := ">>>\npackages: [testpkg]\n---\n•pair[a={x} b={y}]\n•nosuch{z}\n•pa"
+	c.notify("textDocument/didOpen", didOpenParams{textDocumentItem{uri, 1, text}})
+
+	// Diagnostics
+	diags := c.diagnostics()
+	if diags.URI != uri || len(diags.Diagnostics) != 2 {
+		t.Fatalf("expected two diagnostics for %s, got %+v", uri, diags)
+	}
+	if d := diags.Diagnostics[0]; d.Range.Start != (position{4, 1}) || !strings.Contains(d.Message, "nosuch") {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+
+	// Completion
+	var list completionList
+	c.call("textDocument/completion", at(uri, 5, 3), &list)
+	if len(list.Items) != 3 || list.Items[0].Label != "pair" || list.Items[1].Label != "paragraph.begin" {
+		t.Errorf("unexpected completions: %+v", list.Items)
+	}
+
+	// Signature help in the second argument.
+	var help signatureHelp
+	c.call("textDocument/signatureHelp", at(uri, 3, 14), &help)
+	exp := "•pair[a={} b={} sep={|}]"
+	if len(help.Signatures) != 1 || help.Signatures[0].Label != exp || help.ActiveParameter != 1 {
+		t.Errorf("expected %q with parameter 1 active, got %+v", exp, help)
+	}
+
+	// Definition
+	var loc location
+	c.call("textDocument/definition", at(uri, 3, 2), &loc)
+	if loc.URI != pathURI(pkgpath) || loc.Range.Start.Line != 0 {
+		t.Errorf("unexpected definition: %+v", loc)
+	}
+
+	// Hover
+	var h hover
+	c.call("textDocument/hover", at(uri, 3, 5), &h)
+	if !strings.Contains(h.Contents.Value, exp) || !strings.Contains(h.Contents.Value, "<[[.a]][[.sep]][[.b]]>") {
+		t.Errorf("unexpected hover: %q", h.Contents.Value)
+	}
+
+	// Fixing the problem clears the diagnostics.
+	c.notify("textDocument/didChange", didChangeParams{
+		TextDocument: textDocumentIdentifier{uri},
+		ContentChanges: []struct {
+			Text string `json:"text"`
+		}{{">>>\npackages: [testpkg]\n---\n•pair[a={x} b={y}]\n"}},
+	})
+	if diags = c.diagnostics(); len(diags.Diagnostics) != 0 {
+		t.Errorf("expected no diagnostics, got %+v", diags.Diagnostics)
+	}
+
+	c.close()
+}
+
+func TestSignatureWhileTyping(t *testing.T) {
+	f := core.NewFolio()
+	if err := f.LoadPackageText("testpkg.stm", "testpkg.stm", testPackage); err != nil {
+		t.Fatal(err)
+	}
+
+	text := "text •pair[a={one} sep={"
+	d := &document{text: text, folio: f, doc: core.NewDoc("doc.st", "doc.st")}
+	d.doc.Text = text
+
+	s := &Server{}
+	result, err := s.signatureHelp(d, len(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	help, ok := result.(*signatureHelp)
+	if !ok || help.ActiveParameter != 2 {
+		t.Errorf("expected parameter 2 active, got %+v", result)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	text := "a\n𝄞•b\n"
+	p := position{1, 2}
+	if offset := offsetOf(text, p); offset != 6 {
+		t.Errorf("expected offset 6, got %d", offset)
+	}
+	if got := positionOf(text, 6); got != p {
+		t.Errorf("expected %v, got %v", p, got)
+	}
+	if got := runePosition(text, 2, 2); got != p {
+		t.Errorf("expected %v, got %v", p, got)
+	}
+}
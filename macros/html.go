@@ -13,3 +13,114 @@
 // under the License.
 
 package macros
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+// htmlSource defines the html macros that are simple enough to write as
+// templates.
+const htmlSource = `•(newmacro){
+    name: paragraph.begin
+    format: html
+    template: <p>
+}
+•(newmacro){
+    name: paragraph.end
+    format: html
+    template: "</p>\n"
+}
+•(newmacro){
+    name: em
+    format: html
+    parameters: [text]
+    template: <em>[[.text]]</em>
+}
+•(newmacro){
+    name: strong
+    format: html
+    parameters: [text]
+    template: <strong>[[.text]]</strong>
+}
+•(newmacro){
+    name: code
+    format: html
+    parameters: [text]
+    template: <code>[[.text]]</code>
+}
+•(newmacro){
+    name: toc.list
+    format: html
+    parameters: [items]
+    template: "<ul>\n[[.items]]</ul>\n"
+}
+•(newmacro){
+    name: toc.item
+    format: html
+    parameters: [title, link, children]
+    template: "<li><a href=\"[[.link]]\">[[.title]]</a>[[.children]]</li>\n"
+}
+•(newmacro){
+    name: note.marker
+    format: html
+    parameters: [number, id]
+    template: "<sup id=\"[[.id]]-ref\"><a href=\"#[[.id]]\">[[.number]]</a></sup>"
+}
+•(newmacro){
+    name: note.list
+    format: html
+    parameters: [kind, items]
+    template: "<section class=\"[[.kind]]notes\">\n[[.items]]</section>\n"
+}
+•(newmacro){
+    name: note.item
+    format: html
+    parameters: [number, id, text]
+    template: "<p id=\"[[.id]]\"><a href=\"#[[.id]]-ref\">[[.number]]</a> [[.text]]</p>\n"
+}
+`
+
+func init() {
+	p := newPack("html", "html").source(htmlSource).
+		fn("esc", []string{"text"}, nil, htmlEscape).
+		fn("link", []string{"url", "text"}, nil, htmlLink)
+
+	for i := 1; i <= 6; i++ {
+		p.block(fmt.Sprintf("h%d", i), []string{"text"}, []*core.Optional{core.NewOptional("id", "")}, htmlHeading(i))
+	}
+
+	p.register()
+}
+
+// htmlEscape escapes the special HTML characters in its argument.
+func htmlEscape(r *core.Render, args *core.MacroArgs) (string, error) {
+	return html.EscapeString(args.Get("text")), nil
+}
+
+// htmlLink creates an anchor. The url is escaped for use in an attribute.
+func htmlLink(r *core.Render, args *core.MacroArgs) (string, error) {
+	url := strings.TrimSpace(args.Get("url"))
+	if url == "" {
+		return "", fmt.Errorf("link requires a url")
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), args.Get("text")), nil
+}
+
+// htmlHeading returns a macro function for the heading of the given level.
+// Each heading is listed in the tables of contents.
+func htmlHeading(level int) core.MacroFunc {
+	return func(r *core.Render, args *core.MacroArgs) (string, error) {
+		id := strings.TrimSpace(args.Get("id"))
+		if _, err := r.Doc.AddTOCEntry(level, args.Get("text"), id); err != nil {
+			return "", err
+		}
+		if id == "" {
+			return fmt.Sprintf("<h%d>%s</h%d>", level, args.Get("text"), level), nil
+		}
+		return fmt.Sprintf(`<h%d id="%s">%s</h%d>`, level, html.EscapeString(id), args.Get("text"), level), nil
+	}
+}
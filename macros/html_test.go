@@ -0,0 +1,46 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package macros
+
+import (
+	"testing"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+func TestHTMLPackage(t *testing.T) {
+	f := core.NewFolio()
+	f.PkgSearchPaths = nil
+	if err := f.LoadPackages([]string{"html"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d := core.NewDoc("testname", "testpath")
+	d.Text = "•(toc)\n\n•h1[text={Intro} id={intro}]\n\nSome •em{text}•footnote{A •code{note}.} and •esc{<&>} •link[{http://x.org/?a&b}{here}]."
+	d.Format = "html"
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "<ul>\n<li><a href=\"#intro\">Intro</a></li>\n</ul>\n<h1 id=\"intro\">Intro</h1>\n" +
+		"<p>Some <em>text</em><sup id=\"fn1-ref\"><a href=\"#fn1\">1</a></sup> and &lt;&amp;&gt; <a href=\"http://x.org/?a&amp;b\">here</a>.</p>\n" +
+		"<section class=\"footnotes\">\n<p id=\"fn1\"><a href=\"#fn1-ref\">1</a> A <code>note</code>.</p>\n</section>\n"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
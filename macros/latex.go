@@ -0,0 +1,142 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package macros
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+// The latex package writes the same commands as the html package for LaTeX.
+// Footnotes are left to LaTeX. Endnotes are numbered by subtext, and a flush
+// point lists only the endnotes queued since the previous flush point.
+func init() {
+	p := newPack("latex", "latex").
+		fn("paragraph.begin", nil, nil, latexText("")).
+		fn("paragraph.end", nil, nil, latexText("\n\n")).
+		fn("esc", []string{"text"}, nil, latexEscape).
+		fn("em", []string{"text"}, nil, latexCommand(`\emph`)).
+		fn("strong", []string{"text"}, nil, latexCommand(`\textbf`)).
+		fn("code", []string{"text"}, nil, latexCommand(`\texttt`)).
+		fn("toc.list", []string{"items"}, nil, latexTOCList).
+		fn("toc.item", []string{"title", "children"}, nil, latexTOCItem).
+		fn("note.marker", []string{"kind", "number", "text"}, nil, latexNoteMarker).
+		fn("note.list", []string{"kind", "items"}, nil, latexNoteList).
+		fn("note.item", []string{"kind", "number", "text"}, nil, latexNoteItem)
+
+	for i := 1; i <= 6; i++ {
+		p.block(fmt.Sprintf("h%d", i), []string{"text"}, []*core.Optional{core.NewOptional("id", "")}, latexHeading(i))
+	}
+
+	p.register()
+}
+
+// latexSections are the sectioning commands for the heading levels. LaTeX has
+// no sixth level, so h6 is also a subparagraph.
+var latexSections = []string{
+	`\section`, `\subsection`, `\subsubsection`, `\paragraph`, `\subparagraph`, `\subparagraph`,
+}
+
+// latexEscaper replaces the characters that LaTeX treats specially.
+var latexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`&`, `\&`,
+	`%`, `\%`,
+	`$`, `\$`,
+	`#`, `\#`,
+	`_`, `\_`,
+	`~`, `\textasciitilde{}`,
+	`^`, `\textasciicircum{}`,
+)
+
+// latexEscape escapes the special LaTeX characters in its argument.
+func latexEscape(r *core.Render, args *core.MacroArgs) (string, error) {
+	return latexEscaper.Replace(args.Get("text")), nil
+}
+
+// latexText returns a macro function that writes s.
+func latexText(s string) core.MacroFunc {
+	return func(r *core.Render, args *core.MacroArgs) (string, error) {
+		return s, nil
+	}
+}
+
+// latexCommand returns a macro function that passes its text to the LaTeX
+// command.
+func latexCommand(cmd string) core.MacroFunc {
+	return func(r *core.Render, args *core.MacroArgs) (string, error) {
+		return fmt.Sprintf("%s{%s}", cmd, args.Get("text")), nil
+	}
+}
+
+// latexHeading returns a macro function for the heading of the given level.
+// Each heading is listed in the tables of contents.
+func latexHeading(level int) core.MacroFunc {
+	return func(r *core.Render, args *core.MacroArgs) (string, error) {
+		id := strings.TrimSpace(args.Get("id"))
+		if _, err := r.Doc.AddTOCEntry(level, args.Get("text"), id); err != nil {
+			return "", err
+		}
+		if id == "" {
+			return fmt.Sprintf("%s{%s}", latexSections[level-1], args.Get("text")), nil
+		}
+		return fmt.Sprintf(`%s{%s}\label{%s}`, latexSections[level-1], args.Get("text"), id), nil
+	}
+}
+
+// latexTOCList writes a level of a table of contents as a list.
+func latexTOCList(r *core.Render, args *core.MacroArgs) (string, error) {
+	return fmt.Sprintf("\\begin{itemize}\n%s\\end{itemize}\n", args.Get("items")), nil
+}
+
+// latexTOCItem writes an entry of a table of contents followed by the list
+// of its children.
+func latexTOCItem(r *core.Render, args *core.MacroArgs) (string, error) {
+	return fmt.Sprintf("\\item %s\n%s", args.Get("title"), args.Get("children")), nil
+}
+
+// latexNoteMarker writes a footnote where it is marked and lets LaTeX place
+// it. An endnote is marked with its number and written at the flush point.
+func latexNoteMarker(r *core.Render, args *core.MacroArgs) (string, error) {
+	switch kind := args.Get("kind"); kind {
+	case "foot":
+		return fmt.Sprintf(`\footnote{%s}`, args.Get("text")), nil
+	case "end":
+		return fmt.Sprintf(`\textsuperscript{%s}`, args.Get("number")), nil
+	default:
+		return "", fmt.Errorf("unknown kind of note %q", kind)
+	}
+}
+
+// latexNoteList writes the endnotes at a flush point. LaTeX has already
+// placed the footnotes.
+func latexNoteList(r *core.Render, args *core.MacroArgs) (string, error) {
+	if args.Get("kind") == "end" {
+		return fmt.Sprintf("\\begin{description}\n%s\\end{description}\n", args.Get("items")), nil
+	}
+	return "", nil
+}
+
+// latexNoteItem writes an endnote at a flush point.
+func latexNoteItem(r *core.Render, args *core.MacroArgs) (string, error) {
+	if args.Get("kind") == "end" {
+		return fmt.Sprintf("\\item[\\textsuperscript{%s}] %s\n", args.Get("number"), args.Get("text")), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Kevin Kenan
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package macros
+
+import (
+	"testing"
+
+	"github.com/kevinkenan/subtext/core"
+)
+
+func TestLaTeXPackage(t *testing.T) {
+	f := core.NewFolio()
+	f.PkgSearchPaths = nil
+	if err := f.LoadPackages([]string{"latex"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d := core.NewDoc("testname", "testpath")
+	d.Text = "•(toc)\n\n•h1[text={Intro} id={intro}]\n\nOne•endnote{first}.\n\n•(notes)[kind={end}]\n\n" +
+		"•h2{More}\n\nTwo•endnote{second} and •em{three}•footnote{foot}.\n\n•(notes)[kind={end}]"
+	d.Format = "latex"
+	f.AppendDoc(d)
+
+	out, err := f.MakeDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Each flush point lists only the endnotes queued since the last one.
+	exp := "\\begin{itemize}\n\\item Intro\n\\begin{itemize}\n\\item More\n\\end{itemize}\n\\end{itemize}\n" +
+		"\\section{Intro}\\label{intro}\n" +
+		"One\\textsuperscript{1}.\n\n" +
+		"\\begin{description}\n\\item[\\textsuperscript{1}] first\n\\end{description}\n" +
+		"\\subsection{More}\n" +
+		"Two\\textsuperscript{2} and \\emph{three}\\footnote{foot}.\n\n" +
+		"\\begin{description}\n\\item[\\textsuperscript{2}] second\n\\end{description}\n"
+	if out != exp {
+		t.Errorf("\nExpected: %q\n     Got: %q", exp, out)
+	}
+}
@@ -12,4 +12,46 @@
 // License for the specific language governing permissions and limitations
 // under the License.
 
+// Package macros holds the macro packages compiled into subtext. Importing
+// the package registers them so they can be loaded by name, e.g. with
+// "-p html", without any .stm files on disk.
 package macros
+
+import (
+	"github.com/kevinkenan/subtext/core"
+)
+
+// pack builds a built-in package.
+type pack struct {
+	core.Package
+	format string // the format given to every Go macro in the package
+}
+
+func newPack(name, format string) *pack {
+	return &pack{Package: core.Package{Name: name}, format: format}
+}
+
+// source adds macros written in subtext to the package.
+func (p *pack) source(s string) *pack {
+	p.Source += s
+	return p
+}
+
+// fn adds a Go macro to the package.
+func (p *pack) fn(name string, params []string, optionals []*core.Optional, fn core.MacroFunc) *pack {
+	m := core.NewFuncMacro(name, params, optionals, fn)
+	m.Format = p.format
+	p.Macros = append(p.Macros, m)
+	return p
+}
+
+// block adds a Go macro that is rendered as a block.
+func (p *pack) block(name string, params []string, optionals []*core.Optional, fn core.MacroFunc) *pack {
+	p.fn(name, params, optionals, fn)
+	p.Macros[len(p.Macros)-1].Block = true
+	return p
+}
+
+func (p *pack) register() {
+	core.RegisterPackage(&p.Package)
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/kevinkenan/cobra"
 	"github.com/kevinkenan/subtext/commands"
+	_ "github.com/kevinkenan/subtext/macros"
 )
 
 func AppMain(c *cobra.Command, s []string) error {
@@ -52,10 +53,13 @@ func init() {
 	makedoc := commands.Make()
 	build := commands.Build()
 	walk := commands.Walk()
+	serve := commands.Serve()
+	format := commands.Fmt()
+	lsp := commands.LSP()
 
 	// command structure
 	root := cobra.Init(app, cfg)
-	root.SubCmds(makedoc, walk, build)
+	root.SubCmds(makedoc, walk, build, serve, format, lsp)
 
 	cobra.OnInitialize(subtextInit)
 }